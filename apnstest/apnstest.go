@@ -0,0 +1,316 @@
+// Package apnstest provides a fake APNs for tests.
+//
+// The fake accepts the HTTP/2 provider API of APNs, validates the request
+// like APNs does, records the received pushes and responds the scripted
+// failures.
+package apnstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mercari/gaurun/buford/push"
+)
+
+const (
+	// MaxPayload is the maximum size of payload in bytes documented by Apple.
+	// It is not taken from buford so that the fake catches a wrong limit
+	// in the code under test.
+	MaxPayload = 4096
+	// MaxVoIPPayload is the maximum size of payload for VoIP notifications in bytes.
+	MaxVoIPPayload = 5120
+
+	// tokenTimeout is the period a provider token is valid for.
+	tokenTimeout = time.Hour
+)
+
+var validPushTypes = map[string]bool{
+	"alert":        true,
+	"background":   true,
+	"location":     true,
+	"voip":         true,
+	"complication": true,
+	"fileprovider": true,
+	"mdm":          true,
+}
+
+// Push is a push notification received by Handler.
+type Push struct {
+	ID          string          `json:"apns_id"`
+	DeviceToken string          `json:"device_token"`
+	Header      http.Header     `json:"header"`
+	Payload     json.RawMessage `json:"payload"`
+	ReceivedAt  time.Time       `json:"received_at"`
+}
+
+// Failure is a scripted failure of Handler.
+type Failure struct {
+	// Status and Reason are responded as the error of APNs (e.g. 410 and "Unregistered").
+	// They are ignored if Status is 0.
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+	// Delay makes the response slow.
+	Delay time.Duration `json:"delay"`
+	// Reset resets the stream instead of responding.
+	Reset bool `json:"reset"`
+}
+
+// Handler is the fake APNs.
+type Handler struct {
+	// AuthKey verifies the provider token if set. The requests without
+	// a provider token are rejected with MissingProviderToken then.
+	AuthKey *ecdsa.PublicKey
+
+	mu            sync.Mutex
+	pushes        []Push
+	failures      []Failure
+	tokenFailures map[string]Failure
+}
+
+// NewHandler returns a fake APNs.
+func NewHandler() *Handler {
+	return &Handler{tokenFailures: make(map[string]Failure)}
+}
+
+// FailNext makes the next requests fail in order.
+func (h *Handler) FailNext(failures ...Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = append(h.failures, failures...)
+}
+
+// FailToken makes every request to the device token fail.
+func (h *Handler) FailToken(deviceToken string, failure Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokenFailures[deviceToken] = failure
+}
+
+// Pushes returns the push notifications received successfully.
+func (h *Handler) Pushes() []Push {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Push{}, h.pushes...)
+}
+
+// Reset clears the received push notifications and the scripted failures.
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pushes = nil
+	h.failures = nil
+	h.tokenFailures = make(map[string]Failure)
+}
+
+func (h *Handler) nextFailure(deviceToken string) (Failure, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.failures) > 0 {
+		f := h.failures[0]
+		h.failures = h.failures[1:]
+		return f, true
+	}
+	f, ok := h.tokenFailures[deviceToken]
+	return f, ok
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]interface{}{"reason": reason}
+	if status == http.StatusGone {
+		body["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// validate checks the request like APNs and returns the status and the reason of the error.
+func (h *Handler) validate(r *http.Request, deviceToken string, payload []byte) (int, string) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, push.ErrMethodNotAllowed.Error()
+	}
+	if deviceToken == "" {
+		return http.StatusBadRequest, push.ErrMissingDeviceToken.Error()
+	}
+	if !push.IsDeviceTokenValid(deviceToken) {
+		return http.StatusBadRequest, push.ErrBadDeviceToken.Error()
+	}
+
+	if id := r.Header.Get("apns-id"); id != "" && !isUUID(id) {
+		return http.StatusBadRequest, push.ErrBadMessageID.Error()
+	}
+	if exp := r.Header.Get("apns-expiration"); exp != "" {
+		if _, err := strconv.ParseInt(exp, 10, 64); err != nil {
+			return http.StatusBadRequest, push.ErrBadExpirationDate.Error()
+		}
+	}
+	if p := r.Header.Get("apns-priority"); p != "" && p != "5" && p != "10" {
+		return http.StatusBadRequest, push.ErrBadPriority.Error()
+	}
+	pushType := r.Header.Get("apns-push-type")
+	if pushType != "" && !validPushTypes[pushType] {
+		return http.StatusBadRequest, push.ErrInvalidPushType.Error()
+	}
+
+	if h.AuthKey != nil {
+		if r.Header.Get("apns-topic") == "" {
+			return http.StatusBadRequest, push.ErrMissingTopic.Error()
+		}
+		if status, reason := h.validateProviderToken(r.Header.Get("authorization")); status != 0 {
+			return status, reason
+		}
+	}
+
+	maxPayload := MaxPayload
+	if pushType == "voip" {
+		maxPayload = MaxVoIPPayload
+	}
+	if len(payload) == 0 {
+		return http.StatusBadRequest, push.ErrPayloadEmpty.Error()
+	}
+	if len(payload) > maxPayload {
+		return http.StatusRequestEntityTooLarge, push.ErrPayloadTooLarge.Error()
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return http.StatusBadRequest, "BadPayload"
+	}
+	if _, ok := body["aps"]; !ok {
+		return http.StatusBadRequest, "BadPayload"
+	}
+
+	return 0, ""
+}
+
+func (h *Handler) validateProviderToken(authorization string) (int, string) {
+	if authorization == "" {
+		return http.StatusForbidden, push.ErrMissingProviderToken.Error()
+	}
+	bearer := strings.TrimPrefix(authorization, "bearer ")
+	if bearer == authorization {
+		return http.StatusForbidden, push.ErrInvalidProviderToken.Error()
+	}
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(bearer, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		if kid, _ := t.Header["kid"].(string); kid == "" {
+			return nil, fmt.Errorf("kid is missing")
+		}
+		return h.AuthKey, nil
+	})
+	if err != nil || !parsed.Valid {
+		return http.StatusForbidden, push.ErrInvalidProviderToken.Error()
+	}
+	if iss, _ := claims["iss"].(string); iss == "" {
+		return http.StatusForbidden, push.ErrInvalidProviderToken.Error()
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return http.StatusForbidden, push.ErrInvalidProviderToken.Error()
+	}
+	if time.Since(time.Unix(int64(iat), 0)) > tokenTimeout {
+		return http.StatusForbidden, push.ErrExpiredProviderToken.Error()
+	}
+	return 0, ""
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/3/device/") {
+		writeError(w, http.StatusNotFound, push.ErrBadPath.Error())
+		return
+	}
+	deviceToken := strings.TrimPrefix(r.URL.Path, "/3/device/")
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadPayload")
+		return
+	}
+
+	if failure, ok := h.nextFailure(deviceToken); ok {
+		if failure.Delay > 0 {
+			select {
+			case <-time.After(failure.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if failure.Reset {
+			// resets the stream on HTTP/2 and closes the connection on HTTP/1.1
+			panic(http.ErrAbortHandler)
+		}
+		if failure.Status != 0 {
+			writeError(w, failure.Status, failure.Reason)
+			return
+		}
+	}
+
+	if status, reason := h.validate(r, deviceToken, payload); status != 0 {
+		writeError(w, status, reason)
+		return
+	}
+
+	id := r.Header.Get("apns-id")
+	if id == "" {
+		id = newUUID()
+	}
+
+	h.mu.Lock()
+	h.pushes = append(h.pushes, Push{
+		ID:          id,
+		DeviceToken: deviceToken,
+		Header:      r.Header.Clone(),
+		Payload:     payload,
+		ReceivedAt:  time.Now(),
+	})
+	h.mu.Unlock()
+
+	w.Header().Set("apns-id", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Server is a fake APNs listening on HTTP/2 with TLS.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a fake APNs. The caller should call Close when finished.
+// Client of the server trusts its certificate.
+func NewServer() *Server {
+	h := NewHandler()
+	s := httptest.NewUnstartedServer(h)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return &Server{Server: s, Handler: h}
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return false
+	}
+	_, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	return err == nil
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
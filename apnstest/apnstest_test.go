@@ -0,0 +1,184 @@
+package apnstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/buford/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const deviceToken = "1111111111111111111111111111111111111111111111111111111111111111"
+
+func newService(s *Server) *push.Service {
+	return push.NewService(s.Client(), s.URL)
+}
+
+func reasonOf(t *testing.T, err error) string {
+	pushErr, ok := err.(*push.Error)
+	require.True(t, ok, "%v", err)
+	return pushErr.Reason.Error()
+}
+
+func TestServerPush(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	id, err := newService(s).Push(deviceToken, &push.Headers{Topic: "com.example.gaurun", PushType: push.PushTypeAlert}, []byte(`{"aps":{"alert":"hello"}}`))
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	pushes := s.Pushes()
+	require.Len(t, pushes, 1)
+	assert.Equal(t, id, pushes[0].ID)
+	assert.Equal(t, deviceToken, pushes[0].DeviceToken)
+	assert.Equal(t, "com.example.gaurun", pushes[0].Header.Get("apns-topic"))
+	assert.Equal(t, "alert", pushes[0].Header.Get("apns-push-type"))
+	assert.JSONEq(t, `{"aps":{"alert":"hello"}}`, string(pushes[0].Payload))
+
+	s.Reset()
+	assert.Empty(t, s.Pushes())
+}
+
+func TestServerValidate(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	service := newService(s)
+
+	cases := []struct {
+		Name        string
+		DeviceToken string
+		Headers     *push.Headers
+		Payload     string
+		Status      int
+		Reason      string
+	}{
+		{"bad device token", "xyz", nil, `{"aps":{}}`, http.StatusBadRequest, "BadDeviceToken"},
+		{"bad push type", deviceToken, &push.Headers{PushType: "unknown"}, `{"aps":{}}`, http.StatusBadRequest, "InvalidPushType"},
+		{"bad message id", deviceToken, &push.Headers{ID: "id"}, `{"aps":{}}`, http.StatusBadRequest, "BadMessageID"},
+		{"empty payload", deviceToken, nil, ``, http.StatusBadRequest, "PayloadEmpty"},
+		{"malformed payload", deviceToken, nil, `{"alert":"hello"}`, http.StatusBadRequest, "BadPayload"},
+	}
+
+	for _, c := range cases {
+		_, err := service.Push(c.DeviceToken, c.Headers, []byte(c.Payload))
+		require.Error(t, err, c.Name)
+		assert.Equal(t, c.Status, err.(*push.Error).Status, c.Name)
+		assert.Equal(t, c.Reason, reasonOf(t, err), c.Name)
+	}
+	assert.Empty(t, s.Pushes())
+}
+
+func TestServerPayloadTooLarge(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	// push.Service checks the size of payload by itself, so the request is sent directly.
+	payload := `{"aps":{"alert":"` + strings.Repeat("a", MaxPayload) + `"}}`
+	req, err := http.NewRequest("POST", s.URL+"/3/device/"+deviceToken, strings.NewReader(payload))
+	require.NoError(t, err)
+	resp, err := s.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// VoIP notifications can be larger
+	payload = `{"aps":{"alert":"` + strings.Repeat("a", MaxPayload) + `"}}`
+	req, err = http.NewRequest("POST", s.URL+"/3/device/"+deviceToken, strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("apns-push-type", "voip")
+	resp, err = s.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServerProviderToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	s := NewServer()
+	defer s.Close()
+	s.AuthKey = &key.PublicKey
+	service := newService(s)
+	payload := []byte(`{"aps":{}}`)
+
+	authToken := &token.Token{AuthKey: key, KeyID: "key-id", TeamID: "team-id"}
+	_, err = service.Push(deviceToken, &push.Headers{Topic: "com.example.gaurun", AuthToken: authToken}, payload)
+	assert.NoError(t, err)
+
+	_, err = service.Push(deviceToken, &push.Headers{AuthToken: authToken}, payload)
+	assert.Equal(t, "MissingTopic", reasonOf(t, err))
+
+	_, err = service.Push(deviceToken, &push.Headers{Topic: "com.example.gaurun"}, payload)
+	assert.Equal(t, "MissingProviderToken", reasonOf(t, err))
+
+	wrongToken := &token.Token{AuthKey: otherKey, KeyID: "key-id", TeamID: "team-id"}
+	_, err = service.Push(deviceToken, &push.Headers{Topic: "com.example.gaurun", AuthToken: wrongToken}, payload)
+	assert.Equal(t, "InvalidProviderToken", reasonOf(t, err))
+
+	expiredBearer, err := (&jwt.Token{
+		Header: map[string]interface{}{"alg": "ES256", "kid": "key-id"},
+		Claims: jwt.MapClaims{"iss": "team-id", "iat": time.Now().Add(-2 * time.Hour).Unix()},
+		Method: jwt.SigningMethodES256,
+	}).SignedString(key)
+	require.NoError(t, err)
+	// the token is used as it is while it looks valid for the client
+	expiredToken := &token.Token{AuthKey: key, KeyID: "key-id", TeamID: "team-id", IssuedAt: time.Now().Unix(), Bearer: expiredBearer}
+	_, err = service.Push(deviceToken, &push.Headers{Topic: "com.example.gaurun", AuthToken: expiredToken}, payload)
+	assert.Equal(t, "ExpiredProviderToken", reasonOf(t, err))
+
+	assert.Len(t, s.Pushes(), 1)
+}
+
+func TestServerFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	service := newService(s)
+	payload := []byte(`{"aps":{}}`)
+
+	s.FailNext(
+		Failure{Status: http.StatusTooManyRequests, Reason: "TooManyRequests"},
+		Failure{Status: http.StatusInternalServerError, Reason: "InternalServerError"},
+	)
+	_, err := service.Push(deviceToken, nil, payload)
+	assert.Equal(t, "TooManyRequests", reasonOf(t, err))
+	_, err = service.Push(deviceToken, nil, payload)
+	assert.Equal(t, "InternalServerError", reasonOf(t, err))
+	_, err = service.Push(deviceToken, nil, payload)
+	assert.NoError(t, err)
+
+	unregistered := strings.Repeat("2", 64)
+	s.FailToken(unregistered, Failure{Status: http.StatusGone, Reason: "Unregistered"})
+	for i := 0; i < 2; i++ {
+		_, err = service.Push(unregistered, nil, payload)
+		require.Error(t, err)
+		assert.Equal(t, "Unregistered", reasonOf(t, err))
+		assert.False(t, err.(*push.Error).Timestamp.IsZero())
+	}
+
+	s.FailNext(Failure{Reset: true})
+	_, err = service.Push(deviceToken, nil, payload)
+	_, ok := err.(*push.Error)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	s.FailNext(Failure{Delay: time.Second})
+	client := *s.Client()
+	client.Timeout = 100 * time.Millisecond
+	_, err = push.NewService(&client, s.URL).Push(deviceToken, nil, payload)
+	assert.Error(t, err)
+
+	assert.Len(t, s.Pushes(), 1)
+}
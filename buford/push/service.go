@@ -4,12 +4,18 @@ package push
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Apple host locations for configuring Service.
@@ -20,7 +26,21 @@ const (
 	Production2197  = "https://api.push.apple.com:2197"
 )
 
-const maxPayload = 4096 // 4KB at most
+// MaxPayload is the maximum size of payload in bytes.
+const MaxPayload = 4096 // 4KB at most
+
+// MaxVoIPPayload is the maximum size of payload for VoIP notifications in bytes.
+const MaxVoIPPayload = 5120 // 5KB at most
+
+// PayloadLimit returns the maximum size of payload for the push type.
+func PayloadLimit(pushType PushType) int {
+	if pushType == PushTypeVoIP {
+		return MaxVoIPPayload
+	}
+	return MaxPayload
+}
+
+const tracerName = "github.com/mercari/gaurun/buford/push"
 
 // Service is the Apple Push Notification Service that you send notifications to.
 type Service struct {
@@ -52,8 +72,28 @@ func NewClient(cert tls.Certificate) (*http.Client, error) {
 
 // Push sends a notification and waits for a response.
 func (s *Service) Push(deviceToken string, headers *Headers, payload []byte) (string, error) {
+	return s.PushWithContext(context.Background(), deviceToken, headers, payload)
+}
+
+// PushWithContext sends a notification with the context and waits for a response.
+// The request is traced as a child span of the span in ctx.
+func (s *Service) PushWithContext(ctx context.Context, deviceToken string, headers *Headers, payload []byte) (apnsID string, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "apns.push", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	span.SetAttributes(attribute.Int("apns.payload_size", len(payload)))
+
 	// check payload length before even hitting Apple.
-	if len(payload) > maxPayload {
+	var pushType PushType
+	if headers != nil {
+		pushType = headers.PushType
+	}
+	if len(payload) > PayloadLimit(pushType) {
 		return "", &Error{
 			Reason: ErrPayloadTooLarge,
 			Status: http.StatusRequestEntityTooLarge,
@@ -62,7 +102,7 @@ func (s *Service) Push(deviceToken string, headers *Headers, payload []byte) (st
 
 	urlStr := fmt.Sprintf("%v/3/device/%v", s.Host, deviceToken)
 
-	req, err := http.NewRequest("POST", urlStr, bytes.NewReader(payload))
+	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(payload))
 	if err != nil {
 		return "", err
 	}
@@ -76,8 +116,12 @@ func (s *Service) Push(deviceToken string, headers *Headers, payload []byte) (st
 	}
 	defer resp.Body.Close()
 
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
 	if resp.StatusCode == http.StatusOK {
-		return resp.Header.Get("apns-id"), nil
+		apnsID = resp.Header.Get("apns-id")
+		span.SetAttributes(attribute.String("apns.id", apnsID))
+		return apnsID, nil
 	}
 
 	return "", parseErrorResponse(resp.Body, resp.StatusCode)
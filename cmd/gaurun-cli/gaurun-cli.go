@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mercari/gaurun/gaurun"
+)
+
+const usage = `Usage: gaurun-cli [-s server] [-api-token token | -api-key name] <command> [options]
+
+Commands:
+  send     send push notifications given by flags or a JSON/NDJSON file
+  stat     show the statistics of Gaurun (GET /stat/app)
+  pushers  show or adjust core.pusher_max (PUT /config/pushers)
+  loglevel show or change the level of the error log (PUT /config/loglevel)
+  version  show the version
+
+Run 'gaurun-cli <command> -h' for the options of each command.
+
+The server is given by URL (http://127.0.0.1:1056) or unix socket path (unix:/tmp/gaurun.sock).
+
+When the authentication is enabled, give the bearer token of the API key with
+-api-token or $GAURUN_API_TOKEN, or sign the requests with the key given by
+-api-key and the secret in $GAURUN_API_SECRET.
+`
+
+// client calls the APIs of Gaurun.
+type client struct {
+	baseURL string
+	http    *http.Client
+	// token is the bearer token of the API key
+	token string
+	// key and secret sign the requests
+	key    string
+	secret string
+}
+
+func newClient(server string) (*client, error) {
+	if strings.HasPrefix(server, "unix:/") {
+		sockPath := server[5:]
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockPath)
+			},
+		}
+		return &client{
+			baseURL: "http://gaurun",
+			http:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		}, nil
+	}
+
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		baseURL: strings.TrimSuffix(u.String(), "/"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// do calls the API and returns the response body. It returns an error
+// if the status code is not 200.
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var res gaurun.ResponseGaurun
+		if json.Unmarshal(respBody, &res) == nil && res.Message != "" {
+			if len(res.InvalidTokens) > 0 {
+				return nil, fmt.Errorf("%s: %s (invalid tokens: %s)", resp.Status, res.Message, strings.Join(res.InvalidTokens, ", "))
+			}
+			return nil, fmt.Errorf("%s: %s", resp.Status, res.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// authorize adds the credentials of the API key to req.
+func (c *client) authorize(req *http.Request) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.key == "" {
+		return nil
+	}
+
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	signature := gaurun.SignRequest(c.secret, timestamp, nonce, req.Method, req.URL.RequestURI(), body)
+	req.Header.Set(gaurun.AuthKeyHeader, c.key)
+	req.Header.Set(gaurun.AuthTimestampHeader, timestamp)
+	req.Header.Set(gaurun.AuthNonceHeader, nonce)
+	req.Header.Set(gaurun.AuthSignatureHeader, hex.EncodeToString(signature))
+	return nil
+}
+
+// stringsFlag is a flag which can be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// readNotifications reads the notifications from r. It accepts the request
+// body of POST /push, a JSON array of notifications or NDJSON which has a
+// notification per line.
+func readNotifications(r io.Reader) ([]gaurun.RequestGaurunNotification, error) {
+	var notifications []gaurun.RequestGaurunNotification
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch trimmed := bytes.TrimSpace(raw); {
+		case len(trimmed) > 0 && trimmed[0] == '[':
+			var ns []gaurun.RequestGaurunNotification
+			if err := json.Unmarshal(raw, &ns); err != nil {
+				return nil, err
+			}
+			notifications = append(notifications, ns...)
+		default:
+			var req struct {
+				Notifications *[]gaurun.RequestGaurunNotification `json:"notifications"`
+			}
+			if err := json.Unmarshal(raw, &req); err != nil {
+				return nil, err
+			}
+			if req.Notifications != nil {
+				notifications = append(notifications, *req.Notifications...)
+				continue
+			}
+			var n gaurun.RequestGaurunNotification
+			if err := json.Unmarshal(raw, &n); err != nil {
+				return nil, err
+			}
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+func parsePlatform(s string) (int, error) {
+	switch s {
+	case "ios":
+		return gaurun.PlatFormIos, nil
+	case "android":
+		return gaurun.PlatFormAndroid, nil
+	}
+	return 0, fmt.Errorf("platform must be ios or android")
+}
+
+func parseExtends(extends []string) ([]gaurun.ExtendJSON, error) {
+	var result []gaurun.ExtendJSON
+	for _, e := range extends {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("extend must be key=value: %q", e)
+		}
+		result = append(result, gaurun.ExtendJSON{Key: kv[0], Value: kv[1]})
+	}
+	return result, nil
+}
+
+func send(c *client, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	file := fs.String("f", "", "JSON or NDJSON file of notifications ('-' for stdin)")
+	platform := fs.String("platform", "", "platform (ios or android)")
+	var tokens, extends stringsFlag
+	fs.Var(&tokens, "token", "device token. It can be given multiple times")
+	fs.Var(&extends, "extend", "extended field as key=value. It can be given multiple times")
+	message := fs.String("message", "", "message for notification")
+	identifier := fs.String("identifier", "", "identifier for notification")
+	title := fs.String("title", "", "title for notification (iOS)")
+	subtitle := fs.String("subtitle", "", "subtitle for notification (iOS)")
+	pushType := fs.String("push-type", "", "apns-push-type, alert, background or voip (iOS)")
+	apnsID := fs.String("apns-id", "", "apns-id, a UUID to identify the notification (iOS)")
+	badge := fs.Int("badge", 0, "badge count (iOS)")
+	category := fs.String("category", "", "unnotification category (iOS)")
+	sound := fs.String("sound", "", "sound type (iOS)")
+	contentAvailable := fs.Bool("content-available", false, "indicate that new content is available (iOS)")
+	mutableContent := fs.Bool("mutable-content", false, "enable Notification Service app extension (iOS)")
+	expiry := fs.Int("expiry", 0, "expiration for notification in seconds (iOS)")
+	collapseKey := fs.String("collapse-key", "", "the key for collapsing notifications (Android)")
+	delayWhileIdle := fs.Bool("delay-while-idle", false, "the flag for device idling (Android)")
+	timeToLive := fs.Int("time-to-live", 0, "expiration of message kept on FCM storage (Android)")
+	priority := fs.String("priority", "", "priority of message, normal or high (Android)")
+	dryRun := fs.Bool("dry-run", false, "build and log the notifications without delivering them")
+	truncate := fs.Bool("truncate", false, "truncate the message and the title to fit the payload limit")
+	fs.Parse(args)
+
+	var notifications []gaurun.RequestGaurunNotification
+	if *file != "" {
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		notifications, err = readNotifications(r)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", *file, err)
+		}
+	} else {
+		plat, err := parsePlatform(*platform)
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			return fmt.Errorf("token is required")
+		}
+		ext, err := parseExtends(extends)
+		if err != nil {
+			return err
+		}
+		notifications = append(notifications, gaurun.RequestGaurunNotification{
+			Tokens:           tokens,
+			Platform:         plat,
+			Message:          *message,
+			Identifier:       *identifier,
+			CollapseKey:      *collapseKey,
+			DelayWhileIdle:   *delayWhileIdle,
+			TimeToLive:       *timeToLive,
+			Priority:         *priority,
+			Title:            *title,
+			Subtitle:         *subtitle,
+			PushType:         *pushType,
+			ApnsID:           *apnsID,
+			Badge:            *badge,
+			Category:         *category,
+			Sound:            *sound,
+			ContentAvailable: *contentAvailable,
+			MutableContent:   *mutableContent,
+			Expiry:           *expiry,
+			Extend:           ext,
+		})
+	}
+	if len(notifications) == 0 {
+		return fmt.Errorf("no notification to send")
+	}
+	for i := range notifications {
+		if *dryRun {
+			notifications[i].DryRun = true
+		}
+		if *truncate {
+			notifications[i].Truncate = true
+		}
+	}
+
+	respBody, err := c.do("POST", "/push", gaurun.RequestGaurun{Notifications: notifications})
+	if err != nil {
+		return err
+	}
+	var res gaurun.ResponseGaurun
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return err
+	}
+
+	tokenNum := 0
+	for _, n := range notifications {
+		tokenNum += len(n.Tokens)
+	}
+	tokenNum -= len(res.InvalidTokens)
+	// POST /push responds before pushing, so the results for each token
+	// are found only in the access log of Gaurun.
+	fmt.Printf("%s: %d notifications to %d tokens accepted\n", res.Message, len(notifications), tokenNum)
+	for _, token := range res.InvalidTokens {
+		fmt.Printf("rejected invalid token: %s\n", token)
+	}
+	return nil
+}
+
+func printJSON(body []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+func stat(c *client, args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	fs.Parse(args)
+
+	respBody, err := c.do("GET", "/stat/app", nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(respBody)
+}
+
+func pushers(c *client, args []string) error {
+	fs := flag.NewFlagSet("pushers", flag.ExitOnError)
+	max := fs.Int64("max", -1, "new value of core.pusher_max. Shows the current value if omitted")
+	fs.Parse(args)
+
+	if *max < 0 {
+		respBody, err := c.do("GET", "/stat/app", nil)
+		if err != nil {
+			return err
+		}
+		var s gaurun.StatApp
+		if err := json.Unmarshal(respBody, &s); err != nil {
+			return err
+		}
+		fmt.Printf("pusher_max: %d (all workers)\npusher_count: %d\n", s.PusherMax, s.PusherCount)
+		return nil
+	}
+
+	respBody, err := c.do("PUT", fmt.Sprintf("/config/pushers?max=%d", *max), nil)
+	if err != nil {
+		return err
+	}
+	var res gaurun.ResponseGaurun
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return err
+	}
+	fmt.Println(res.Message)
+	return nil
+}
+
+func loglevel(c *client, args []string) error {
+	fs := flag.NewFlagSet("loglevel", flag.ExitOnError)
+	level := fs.String("level", "", "new level of the error log. Shows the current level if omitted")
+	minutes := fs.Int("minutes", 0, "minutes to revert the level after. It is not reverted if 0")
+	fs.Parse(args)
+
+	method, path := "GET", "/config/loglevel"
+	if *level != "" {
+		method = "PUT"
+		path += fmt.Sprintf("?level=%s&minutes=%d", url.QueryEscape(*level), *minutes)
+	}
+	respBody, err := c.do(method, path, nil)
+	if err != nil {
+		return err
+	}
+	var res gaurun.ResponseLogLevel
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return err
+	}
+	fmt.Printf("level: %s\n", res.Level)
+	if res.RevertsAt != "" {
+		fmt.Printf("reverts_at: %s\n", res.RevertsAt)
+	}
+	return nil
+}
+
+func main() {
+	server := flag.String("s", "http://127.0.0.1:1056", "gaurun server")
+	token := flag.String("api-token", os.Getenv("GAURUN_API_TOKEN"), "bearer token of the API key")
+	key := flag.String("api-key", "", "name of the API key to sign the requests with $GAURUN_API_SECRET")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c.token = *token
+	if *key != "" {
+		c.key, c.secret = *key, os.Getenv("GAURUN_API_SECRET")
+		if c.secret == "" {
+			fmt.Fprintln(os.Stderr, "GAURUN_API_SECRET must be set with -api-key")
+			os.Exit(2)
+		}
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "send":
+		err = send(c, args)
+	case "stat":
+		err = stat(c, args)
+	case "pushers":
+		err = pushers(c, args)
+	case "loglevel":
+		err = loglevel(c, args)
+	case "version":
+		gaurun.PrintVersion()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		os.Exit(1)
+	}
+}
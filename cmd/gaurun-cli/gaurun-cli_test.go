@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mercari/gaurun/gaurun"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadNotifications(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+	}{
+		{"request body", `{"notifications":[{"token":["a"],"platform":1,"message":"hello"},{"token":["b"],"platform":2,"message":"hello"}]}`},
+		{"array", `[{"token":["a"],"platform":1,"message":"hello"},{"token":["b"],"platform":2,"message":"hello"}]`},
+		{"ndjson", "{\"token\":[\"a\"],\"platform\":1,\"message\":\"hello\"}\n{\"token\":[\"b\"],\"platform\":2,\"message\":\"hello\"}\n"},
+	}
+
+	for _, c := range cases {
+		notifications, err := readNotifications(strings.NewReader(c.Input))
+		require.NoError(t, err, c.Name)
+		require.Len(t, notifications, 2, c.Name)
+		assert.Equal(t, []string{"a"}, notifications[0].Tokens, c.Name)
+		assert.Equal(t, gaurun.PlatFormAndroid, notifications[1].Platform, c.Name)
+	}
+
+	_, err := readNotifications(strings.NewReader(`{"token":`))
+	assert.Error(t, err)
+}
+
+func TestSend(t *testing.T) {
+	var received gaurun.RequestGaurun
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/push", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Write([]byte(`{"message":"ok"}`))
+	}))
+	defer ts.Close()
+
+	c, err := newClient(ts.URL)
+	require.NoError(t, err)
+
+	err = send(c, []string{"-platform", "ios", "-token", "a", "-token", "b", "-message", "hello", "-extend", "url=https://example.com/?a=b"})
+	require.NoError(t, err)
+	require.Len(t, received.Notifications, 1)
+	assert.Equal(t, []string{"a", "b"}, received.Notifications[0].Tokens)
+	assert.Equal(t, []gaurun.ExtendJSON{{Key: "url", Value: "https://example.com/?a=b"}}, received.Notifications[0].Extend)
+
+	assert.Error(t, send(c, []string{"-platform", "windows", "-token", "a"}))
+	assert.Error(t, send(c, []string{"-platform", "ios"}))
+	assert.Error(t, send(c, []string{"-platform", "ios", "-token", "a", "-extend", "url"}))
+}
+
+func TestClientError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"malformed value"}`))
+	}))
+	defer ts.Close()
+
+	c, err := newClient(strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	_, err = c.do("PUT", "/config/pushers?max=-1", nil)
+	assert.EqualError(t, err, "400 Bad Request: malformed value")
+}
+
+func TestClientAuthorize(t *testing.T) {
+	auth := gaurun.NewHMACAuthenticator([]gaurun.APIKey{{Name: "cli", Secret: "secret", Scopes: []string{gaurun.AuthScopeAdmin}}}, time.Minute, 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := auth.Authenticate(r)
+		if err != nil || key == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"unauthorized"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"ok"}`))
+	}))
+	defer ts.Close()
+
+	c, err := newClient(ts.URL)
+	require.NoError(t, err)
+	_, err = c.do("PUT", "/config/pushers?max=1", nil)
+	assert.EqualError(t, err, "401 Unauthorized: unauthorized")
+
+	c.key, c.secret = "cli", "secret"
+	_, err = c.do("PUT", "/config/pushers?max=1", nil)
+	assert.NoError(t, err)
+	_, err = c.do("POST", "/push", gaurun.RequestGaurun{})
+	assert.NoError(t, err)
+
+	c.secret = "wrong"
+	_, err = c.do("PUT", "/config/pushers?max=2", nil)
+	assert.Error(t, err)
+}
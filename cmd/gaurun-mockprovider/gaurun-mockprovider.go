@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mercari/gaurun/apnstest"
+	"github.com/mercari/gaurun/buford/token"
+	"github.com/mercari/gaurun/fcmtest"
+	"github.com/mercari/gaurun/gaurun"
+)
+
+// failureRequest is the body of POST /apns/failures and POST /fcm/failures.
+// The failure applies to every request to Token if it is given, otherwise
+// to the next request.
+type failureRequest struct {
+	Token      string `json:"token"`
+	Status     int    `json:"status"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after"`
+	Delay      string `json:"delay"`
+	Reset      bool   `json:"reset"`
+}
+
+func (f failureRequest) delay() (time.Duration, error) {
+	if f.Delay == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(f.Delay)
+}
+
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func sendError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func decodeFailure(w http.ResponseWriter, r *http.Request) (failureRequest, time.Duration, bool) {
+	var f failureRequest
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		sendError(w, "request body parse error", http.StatusBadRequest)
+		return f, 0, false
+	}
+	delay, err := f.delay()
+	if err != nil {
+		sendError(w, "delay must be a duration (e.g. 3s)", http.StatusBadRequest)
+		return f, 0, false
+	}
+	return f, delay, true
+}
+
+// adminHandler returns the handler to inspect and script the fake providers.
+func adminHandler(apns *apnstest.Handler, fcm *fcmtest.Handler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/apns/pushes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			sendJSON(w, apns.Pushes())
+		case "DELETE":
+			apns.Reset()
+			sendJSON(w, map[string]string{"message": "ok"})
+		default:
+			sendError(w, "method must be GET or DELETE", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/apns/failures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			sendError(w, "method must be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		f, delay, ok := decodeFailure(w, r)
+		if !ok {
+			return
+		}
+		failure := apnstest.Failure{Status: f.Status, Reason: f.Reason, Delay: delay, Reset: f.Reset}
+		if f.Token != "" {
+			apns.FailToken(f.Token, failure)
+		} else {
+			apns.FailNext(failure)
+		}
+		sendJSON(w, map[string]string{"message": "ok"})
+	})
+
+	mux.HandleFunc("/fcm/messages", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			sendJSON(w, fcm.Messages())
+		case "DELETE":
+			fcm.Reset()
+			sendJSON(w, map[string]string{"message": "ok"})
+		default:
+			sendError(w, "method must be GET or DELETE", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/fcm/failures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			sendError(w, "method must be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		f, delay, ok := decodeFailure(w, r)
+		if !ok {
+			return
+		}
+		failure := fcmtest.Failure{Status: f.Status, RetryAfter: f.RetryAfter, Error: f.Error, Delay: delay, Reset: f.Reset}
+		if f.Token != "" {
+			fcm.FailToken(f.Token, failure)
+		} else {
+			fcm.FailNext(failure)
+		}
+		sendJSON(w, map[string]string{"message": "ok"})
+	})
+
+	return mux
+}
+
+// generateCertificate generates a self-signed certificate for localhost.
+// The certificate is also a CA so that it can be given to ios.root_ca_path.
+func generateCertificate() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"gaurun-mockprovider"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM, nil
+}
+
+func loadCertificate(certPath, keyPath, certOut string) (tls.Certificate, error) {
+	if certPath != "" || keyPath != "" {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	cert, certPEM, err := generateCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certOut != "" {
+		if err := ioutil.WriteFile(certOut, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return cert, nil
+}
+
+func main() {
+	versionPrinted := flag.Bool("v", false, "gaurun version")
+	apnsAddr := flag.String("apns", "127.0.0.1:8443", "address of the fake APNs (HTTP/2 over TLS). Empty disables it")
+	certPath := flag.String("apns-cert", "", "certificate file path of the fake APNs. A self-signed certificate is generated if empty")
+	keyPath := flag.String("apns-key", "", "key file path of the fake APNs")
+	certOut := flag.String("apns-cert-out", "", "file path to write the generated certificate to, for ios.root_ca_path")
+	authKeyPath := flag.String("apns-auth-key", "", "APNs auth key file (.p8) to verify provider tokens with")
+	fcmAddr := flag.String("fcm", "127.0.0.1:8080", "address of the fake FCM. Empty disables it")
+	fcmAPIKey := flag.String("fcm-apikey", "", "API key the fake FCM accepts. Any key is accepted if empty")
+	adminAddr := flag.String("admin", "127.0.0.1:8081", "address of the admin API to inspect and script the fake providers")
+	flag.Parse()
+
+	if *versionPrinted {
+		gaurun.PrintVersion()
+		os.Exit(0)
+	}
+
+	if *apnsAddr == "" && *fcmAddr == "" {
+		log.Fatal("either -apns or -fcm must be given")
+	}
+
+	apns := apnstest.NewHandler()
+	fcm := fcmtest.NewHandler()
+	fcm.APIKey = *fcmAPIKey
+
+	if *authKeyPath != "" {
+		authKey, err := token.AuthKeyFromFile(*authKeyPath)
+		if err != nil {
+			log.Fatalf("failed to load the auth key: %v", err)
+		}
+		apns.AuthKey = &authKey.PublicKey
+	}
+
+	errCh := make(chan error, 3)
+
+	if *apnsAddr != "" {
+		cert, err := loadCertificate(*certPath, *keyPath, *certOut)
+		if err != nil {
+			log.Fatalf("failed to load the certificate: %v", err)
+		}
+		server := &http.Server{
+			Addr:      *apnsAddr,
+			Handler:   apns,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		log.Printf("fake APNs listening on https://%s", *apnsAddr)
+		go func() { errCh <- server.ListenAndServeTLS("", "") }()
+	}
+
+	if *fcmAddr != "" {
+		log.Printf("fake FCM listening on http://%s", *fcmAddr)
+		go func() { errCh <- http.ListenAndServe(*fcmAddr, fcm) }()
+	}
+
+	if *adminAddr != "" {
+		log.Printf("admin API listening on http://%s", *adminAddr)
+		go func() { errCh <- http.ListenAndServe(*adminAddr, adminHandler(apns, fcm)) }()
+	}
+
+	log.Fatalf("failed to serve: %v", <-errCh)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mercari/gaurun/apnstest"
+	"github.com/mercari/gaurun/fcmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	apns := apnstest.NewHandler()
+	fcm := fcmtest.NewHandler()
+	admin := httptest.NewServer(adminHandler(apns, fcm))
+	defer admin.Close()
+
+	post := func(path, body string) int {
+		resp, err := http.Post(admin.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post("/apns/failures", `{"status":410,"reason":"Unregistered","delay":"10ms"}`))
+	assert.Equal(t, http.StatusOK, post("/fcm/failures", `{"token":"token","error":"NotRegistered"}`))
+	assert.Equal(t, http.StatusBadRequest, post("/fcm/failures", `{"delay":"soon"}`))
+
+	deviceToken := strings.Repeat("1", 64)
+	w := httptest.NewRecorder()
+	stime := time.Now()
+	apns.ServeHTTP(w, httptest.NewRequest("POST", "/3/device/"+deviceToken, strings.NewReader(`{"aps":{}}`)))
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.True(t, time.Since(stime) >= 10*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"registration_ids":["token"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	fcm.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "NotRegistered")
+
+	resp, err := http.Get(admin.URL + "/apns/pushes")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestGenerateCertificate(t *testing.T) {
+	cert, certPEM, err := generateCertificate()
+	require.NoError(t, err)
+	assert.Len(t, cert.Certificate, 1)
+	assert.Contains(t, string(certPEM), "BEGIN CERTIFICATE")
+}
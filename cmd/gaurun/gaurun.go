@@ -13,7 +13,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/mercari/gaurun/buford/token"
 	"github.com/mercari/gaurun/gaurun"
 )
 
@@ -27,6 +26,7 @@ func main() {
 	listenPort := flag.String("p", "", "port number or unix socket path")
 	workerNum := flag.Int64("w", 0, "number of workers for push notification")
 	queueNum := flag.Int64("q", 0, "size of internal queue for push notification")
+	confChecked := flag.Bool("t", false, "test configuration and exit")
 	flag.Parse()
 
 	if *versionPrinted {
@@ -34,11 +34,7 @@ func main() {
 		return
 	}
 
-	// set default parameters
-	gaurun.ConfGaurun = gaurun.BuildDefaultConf()
-
-	// load configuration
-	conf, err := gaurun.LoadConf(gaurun.ConfGaurun, *confPath)
+	conf, err := gaurun.BuildConf(*confPath, os.LookupEnv)
 	if err != nil {
 		gaurun.LogSetupFatal(err)
 	}
@@ -59,12 +55,32 @@ func main() {
 		gaurun.ConfGaurun.Core.QueueNum = *queueNum
 	}
 
+	// read secrets given by *_file keys
+	gaurun.ConfGaurun, err = gaurun.LoadConfSecretFiles(gaurun.ConfGaurun)
+	if err != nil {
+		gaurun.LogSetupFatal(err)
+	}
+
+	if *confChecked {
+		if !gaurun.CheckConf(os.Stdout, gaurun.ConfGaurun, *confPath) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if errs := gaurun.ValidateConf(gaurun.ConfGaurun); len(errs) > 0 {
+		gaurun.LogSetupFatal(errs[0])
+	}
+
 	// set logger
 	accessLogger, accessLogReopener, err := gaurun.InitLog(gaurun.ConfGaurun.Log.AccessLog, "info")
 	if err != nil {
 		gaurun.LogSetupFatal(err)
 	}
-	errorLogger, errorLogReopener, err := gaurun.InitLog(gaurun.ConfGaurun.Log.ErrorLog, gaurun.ConfGaurun.Log.Level)
+	if err := gaurun.LogErrorLevel.UnmarshalText([]byte(gaurun.ConfGaurun.Log.Level)); err != nil {
+		gaurun.LogSetupFatal(err)
+	}
+	errorLogger, errorLogReopener, err := gaurun.InitLogLevel(gaurun.ConfGaurun.Log.ErrorLog, gaurun.LogErrorLevel)
 	if err != nil {
 		gaurun.LogSetupFatal(err)
 	}
@@ -72,39 +88,35 @@ func main() {
 	gaurun.LogAccess = accessLogger
 	gaurun.LogError = errorLogger
 
-	if !gaurun.ConfGaurun.Ios.Enabled && !gaurun.ConfGaurun.Android.Enabled {
-		gaurun.LogSetupFatal(fmt.Errorf("no platform has been enabled"))
+	// the payload log has the tokens and the content as they are,
+	// so only the owner can read it.
+	var payloadLogReopener gaurun.Reopener
+	if gaurun.ConfGaurun.Log.PayloadLog != "" {
+		gaurun.LogPayload, payloadLogReopener, err = gaurun.InitLogMode(gaurun.ConfGaurun.Log.PayloadLog, "info", 0600)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
 	}
 
-	if gaurun.ConfGaurun.Ios.Enabled {
-		if gaurun.ConfGaurun.Ios.IsCertificateBasedProvider() && gaurun.ConfGaurun.Ios.IsTokenBasedProvider() {
-			gaurun.LogSetupFatal(fmt.Errorf("you can use only one of certificate-based provider or token-based provider connection trust"))
+	var auditLogReopener gaurun.Reopener
+	if gaurun.ConfGaurun.Log.AuditLog != "" {
+		gaurun.LogAudit, auditLogReopener, err = gaurun.InitLog(gaurun.ConfGaurun.Log.AuditLog, "info")
+		if err != nil {
+			gaurun.LogSetupFatal(err)
 		}
+	}
 
-		if gaurun.ConfGaurun.Ios.IsCertificateBasedProvider() {
-			_, err = ioutil.ReadFile(gaurun.ConfGaurun.Ios.PemCertPath)
-			if err != nil {
-				gaurun.LogSetupFatal(fmt.Errorf("the certification file for iOS was not found"))
-			}
+	gaurun.LogEffectiveConf(gaurun.ConfGaurun)
 
-			_, err = ioutil.ReadFile(gaurun.ConfGaurun.Ios.PemKeyPath)
-			if err != nil {
-				gaurun.LogSetupFatal(fmt.Errorf("the key file for iOS was not found"))
-			}
-		} else if gaurun.ConfGaurun.Ios.IsTokenBasedProvider() {
-			_, err = token.AuthKeyFromFile(gaurun.ConfGaurun.Ios.TokenAuthKeyPath)
-			if err != nil {
-				gaurun.LogSetupFatal(fmt.Errorf("the auth key file for iOS was not loading: %v", err))
-			}
-		} else {
-			gaurun.LogSetupFatal(fmt.Errorf("the key file or APNsAuthKey file for iOS was not found"))
-		}
+	if err := gaurun.ValidateProviders(gaurun.ConfGaurun); err != nil {
+		gaurun.LogSetupFatal(err)
 	}
 
-	if gaurun.ConfGaurun.Android.Enabled {
-		if gaurun.ConfGaurun.Android.ApiKey == "" {
-			gaurun.LogSetupFatal(fmt.Errorf("the APIKey for Android cannot be empty"))
-		}
+	if err := gaurun.InitAuth(gaurun.ConfGaurun.Auth); err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to load API keys: %v", err))
+	}
+	if gaurun.ConfGaurun.Auth.KeysFile == "" {
+		gaurun.LogError.Warn("the API is not authenticated since auth.keys_file is not set")
 	}
 
 	sigHUPChan := make(chan os.Signal, 1)
@@ -117,6 +129,36 @@ func main() {
 		if err := errorLogReopener.Reopen(); err != nil {
 			gaurun.LogError.Warn(fmt.Sprintf("failed to reopen error log: %v", err))
 		}
+		if payloadLogReopener != nil {
+			if err := payloadLogReopener.Reopen(); err != nil {
+				gaurun.LogError.Warn(fmt.Sprintf("failed to reopen payload log: %v", err))
+			}
+		}
+		if auditLogReopener != nil {
+			if err := auditLogReopener.Reopen(); err != nil {
+				gaurun.LogError.Warn(fmt.Sprintf("failed to reopen audit log: %v", err))
+			}
+		}
+
+		// reload the number of workers and the size of queue.
+		newConf, err := reloadConf(*confPath, *workerNum, *queueNum)
+		if err != nil {
+			gaurun.LogError.Warn(fmt.Sprintf("failed to reload configuration: %v", err))
+			return
+		}
+		// the API keys are reloaded to rotate them
+		if err := gaurun.InitAuth(newConf.Auth); err != nil {
+			gaurun.LogError.Warn(fmt.Sprintf("failed to reload API keys: %v", err))
+		} else {
+			gaurun.LogSignalAction(syscall.SIGHUP, "reload-auth", gaurun.ConfGaurun.Auth.KeysFile, newConf.Auth.KeysFile)
+			gaurun.ConfGaurun.Auth = newConf.Auth
+		}
+
+		oldWorkerNum, oldQueueNum := gaurun.ResizePushWorkers(newConf.Core.WorkerNum, newConf.Core.QueueNum)
+		gaurun.LogSignalAction(syscall.SIGHUP, "reload",
+			map[string]int64{"workers": oldWorkerNum, "queues": oldQueueNum},
+			map[string]int64{"workers": newConf.Core.WorkerNum, "queues": newConf.Core.QueueNum},
+		)
 	}
 
 	go signalHandler(sigHUPChan, sighupHandler)
@@ -141,9 +183,25 @@ func main() {
 		}
 	}
 
+	shutdownTracer, err := gaurun.InitTracer(gaurun.ConfGaurun.Trace)
+	if err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("failed to init tracer: %v", err))
+	}
+
 	gaurun.InitStat()
 	gaurun.StartPushWorkers(gaurun.ConfGaurun.Core.WorkerNum, gaurun.ConfGaurun.Core.QueueNum)
 
+	// re-enqueue the notifications left on the last shutdown before accepting new ones
+	if queueFile := gaurun.ConfGaurun.Core.QueueFile; queueFile != "" {
+		n, err := gaurun.RestoreQueue(queueFile)
+		if err != nil {
+			gaurun.LogSetupFatal(fmt.Errorf("failed to restore queue from %s: %v", queueFile, err))
+		}
+		if n > 0 {
+			gaurun.LogError.Info(fmt.Sprintf("restored %d notifications from %s", n, queueFile))
+		}
+	}
+
 	mux := http.NewServeMux()
 	gaurun.RegisterHandlers(mux)
 
@@ -165,6 +223,15 @@ func main() {
 	signal.Notify(sigTERMChan, syscall.SIGTERM)
 
 	<-sigTERMChan
+
+	// Fail the readiness check and keep serving for a while so that
+	// load balancers stop sending new requests.
+	gaurun.BeginShutdown()
+	if delay := gaurun.ConfGaurun.Core.ShutdownDelay; delay > 0 {
+		gaurun.LogError.Info(fmt.Sprintf("wait %d seconds before shutdown", delay))
+		time.Sleep(time.Duration(delay) * time.Second)
+	}
+
 	gaurun.LogError.Info("shutdown server")
 	timeout := time.Duration(conf.Core.ShutdownTimeout) * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -173,25 +240,60 @@ func main() {
 		gaurun.LogError.Error(fmt.Sprintf("failed to shutdown server: %v", err))
 	}
 
-	// Start a goroutine to log number of job queue.
-	go func() {
-		for {
-			queue := len(gaurun.QueueNotification)
-			if queue == 0 {
-				break
-			}
-
-			gaurun.LogError.Info(fmt.Sprintf("wait until queue is empty. Current queue len: %d", queue))
-			time.Sleep(1 * time.Second)
+	if queueFile := gaurun.ConfGaurun.Core.QueueFile; queueFile != "" {
+		// Give workers shutdown_timeout to flush the queue, then stop them
+		// and save the rest to be pushed on the next start.
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), timeout)
+		defer drainCancel()
+		gaurun.WaitQueueEmpty(drainCtx)
+		gaurun.StopPushWorkers()
+		n, err := gaurun.SaveQueue(queueFile)
+		if err != nil {
+			gaurun.LogError.Error(fmt.Sprintf("failed to save queue to %s: %v", queueFile, err))
+		} else if n > 0 {
+			gaurun.LogError.Info(fmt.Sprintf("saved %d notifications to %s", n, queueFile))
 		}
-	}()
+	} else {
+		// Start a goroutine to log number of job queue.
+		go gaurun.WaitQueueEmpty(context.Background())
+	}
 
 	// Block until all pusher worker job is done.
 	gaurun.PusherWg.Wait()
 
+	// Flush the remaining spans.
+	traceCtx, traceCancel := context.WithTimeout(context.Background(), timeout)
+	defer traceCancel()
+	if err := shutdownTracer(traceCtx); err != nil {
+		gaurun.LogError.Error(fmt.Sprintf("failed to shutdown tracer: %v", err))
+	}
+
 	gaurun.LogError.Info("successfully shutdown")
 }
 
+// reloadConf loads the configuration again on SIGHUP. The values given by
+// flags take precedence as well as on startup.
+func reloadConf(confPath string, workerNum, queueNum int64) (gaurun.ConfToml, error) {
+	conf, err := gaurun.BuildConf(confPath, os.LookupEnv)
+	if err != nil {
+		return conf, err
+	}
+	if workerNum > 0 {
+		conf.Core.WorkerNum = workerNum
+	}
+	if queueNum > 0 {
+		conf.Core.QueueNum = queueNum
+	}
+	conf, err = gaurun.LoadConfSecretFiles(conf)
+	if err != nil {
+		return conf, err
+	}
+	if errs := gaurun.ValidateConf(conf); len(errs) > 0 {
+		return conf, errs[0]
+	}
+	return conf, nil
+}
+
 func signalHandler(ch <-chan os.Signal, sighupFn func()) {
 	for sig := range ch {
 		switch sig {
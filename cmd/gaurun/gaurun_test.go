@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConf(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "token_hash_key")
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("secret\n"), 0600))
+	confPath := filepath.Join(dir, "gaurun.toml")
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`
+[core]
+workers = 4
+queues = 1024
+
+[log]
+token_mask = "hash"
+token_hash_key_file = "`+keyPath+`"
+`), 0600))
+
+	conf, err := reloadConf(confPath, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", conf.Log.TokenHashKey)
+	assert.Equal(t, int64(4), conf.Core.WorkerNum)
+	assert.Equal(t, int64(1024), conf.Core.QueueNum)
+
+	// the flags take precedence
+	conf, err = reloadConf(confPath, 8, 2048)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), conf.Core.WorkerNum)
+	assert.Equal(t, int64(2048), conf.Core.QueueNum)
+
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`
+[log]
+token_mask = "hash"
+`), 0600))
+	_, err = reloadConf(confPath, 0, 0)
+	assert.EqualError(t, err, "log.token_hash_key must be set when log.token_mask is hash")
+}
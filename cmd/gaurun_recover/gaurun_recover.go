@@ -1,21 +1,18 @@
 package main
 
 import (
-	"bufio"
-	"crypto/ecdsa"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"net/http"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/mercari/gaurun/buford/token"
 	"github.com/mercari/gaurun/gaurun"
 	"github.com/mercari/gaurun/gcm"
+
+	"go.uber.org/zap"
 )
 
 var (
@@ -23,63 +20,138 @@ var (
 	GCMClient  *gcm.Client
 )
 
-func pushNotification(wg *sync.WaitGroup, req gaurun.RequestGaurunNotification, logPush gaurun.LogPushEntry) {
-	var result bool
-	switch logPush.Platform {
-	case "ios":
-		result = pushNotificationIos(req)
-	case "android":
-		result = pushNotificationAndroid(req)
-	}
-	if !result {
-		msg := fmt.Sprintf("failed to push notification: %s %s %s", logPush.Token, logPush.Platform, logPush.Message)
-		log.Println(msg)
-	} else {
-		msg := fmt.Sprintf("succeeded push notification: %s %s %s", logPush.Token, logPush.Platform, logPush.Message)
-		log.Println(msg)
-	}
-
-	wg.Done()
+// filter selects the lost push notifications to recover.
+type filter struct {
+	since      time.Time
+	until      time.Time
+	platform   string
+	identifier string
 }
 
-func pushNotificationAndroid(req gaurun.RequestGaurunNotification) bool {
-	data := map[string]interface{}{"message": req.Message}
-	msg := gcm.NewMessage(data, req.Tokens...)
-	msg.CollapseKey = req.CollapseKey
-	msg.DelayWhileIdle = req.DelayWhileIdle
-	msg.TimeToLive = req.TimeToLive
-	msg.Priority = req.Priority
-
-	_, err := GCMClient.Send(msg)
+func (f *filter) match(logPush gaurun.LogPushEntry) bool {
+	if f.platform != "" && logPush.Platform != f.platform {
+		return false
+	}
+	if f.identifier != "" && logPush.Identifier != f.identifier {
+		return false
+	}
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+	t, err := gaurun.ParseLogTime(logPush.Time)
 	if err != nil {
+		log.Printf("time parse error(%s)", logPush.Time)
+		return false
+	}
+	if !f.since.IsZero() && t.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !t.Before(f.until) {
 		return false
 	}
-
 	return true
 }
 
-func pushNotificationIos(req gaurun.RequestGaurunNotification) bool {
+func parseTimeFlag(name, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		gaurun.LogSetupFatal(fmt.Errorf("-%s must be RFC3339 (e.g. 2006-01-02T15:04:05+09:00): %v", name, err))
+	}
+	return t
+}
 
+// pushNotification pushes req and returns the message ID given by the provider.
+func pushNotification(req gaurun.RequestGaurunNotification) (string, error) {
+	switch req.Platform {
+	case gaurun.PlatFormIos:
+		if !gaurun.ConfGaurun.Ios.Enabled {
+			return "", fmt.Errorf("push notification for iOS is disabled")
+		}
+		return pushNotificationIos(req)
+	case gaurun.PlatFormAndroid:
+		if !gaurun.ConfGaurun.Android.Enabled {
+			return "", fmt.Errorf("push notification for Android is disabled")
+		}
+		return pushNotificationAndroid(req)
+	}
+	return "", fmt.Errorf("invalid platform: %d", req.Platform)
+}
+
+func pushNotificationAndroid(req gaurun.RequestGaurunNotification) (string, error) {
+	resp, err := GCMClient.Send(gaurun.NewGcmMessage(&req))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Results) == 0 {
+		return "", nil
+	}
+	if resp.Results[0].Error != "" {
+		return "", fmt.Errorf("%s", resp.Results[0].Error)
+	}
+	return resp.Results[0].MessageID, nil
+}
+
+func pushNotificationIos(req gaurun.RequestGaurunNotification) (string, error) {
 	service := gaurun.NewApnsServiceHttp2(APNSClient)
 
-	for _, token := range req.Tokens {
+	headers := gaurun.NewApnsHeadersHttp2(&req)
+	if APNSClient.Token != nil {
+		headers = gaurun.NewApnsHeadersHttp2WithToken(&req, APNSClient.Token)
+	}
+	payload := gaurun.NewApnsPayloadHttp2(&req)
 
-		headers := gaurun.NewApnsHeadersHttp2(&req)
-		payload := gaurun.NewApnsPayloadHttp2(&req)
+	if req.IsDryRun() {
+		return "", gaurun.ValidateApnsPushHttp2(req.Tokens[0], headers, payload)
+	}
+	return gaurun.ApnsPushHttp2WithID(req.Tokens[0], service, headers, payload)
+}
 
-		err := gaurun.ApnsPushHttp2(token, service, headers, payload)
-		if err != nil {
-			return false
-		}
+// recoverNotification pushes req and records the result.
+// The results log has the ID in the original log so that it can be
+// correlated with the accepted push notification on the next run.
+func recoverNotification(req gaurun.RequestGaurunNotification, results *zap.Logger) {
+	stime := time.Now()
+	messageID, err := pushNotification(req)
+	req.MessageID = messageID
+	ptime := time.Since(stime).Seconds()
+
+	status := gaurun.StatusSucceededPush
+	if req.IsDryRun() {
+		status = gaurun.StatusDryRunPush
+	}
+	masked := gaurun.MaskNotification(req)
+	if err != nil {
+		status = gaurun.StatusFailedPush
+		log.Printf("failed to push notification: %d %s %d %s: %v", req.ID, masked.Tokens[0], req.Platform, masked.Message, err)
+	} else if req.IsDryRun() {
+		log.Printf("dry-run push notification: %d %s %d %s", req.ID, masked.Tokens[0], req.Platform, masked.Message)
+	} else {
+		log.Printf("succeeded push notification: %d %s %d %s %s", req.ID, masked.Tokens[0], req.Platform, masked.Message, messageID)
 	}
 
-	return true
+	if results != nil {
+		gaurun.LogPushTo(results, req.ID, status, req.Tokens[0], ptime, req, err)
+	}
 }
 
 func main() {
 	versionPrinted := flag.Bool("v", false, "gaurun version")
 	confPath := flag.String("c", "", "configuration file path for gaurun")
-	logPath := flag.String("l", "", "log file path for gaurun")
+	var logPaths stringsFlag
+	flag.Var(&logPaths, "l", "log file path for gaurun. It can be given multiple times and can be a glob pattern. Files ending with .gz are decompressed")
+	var payloadPaths stringsFlag
+	flag.Var(&payloadPaths, "payloads", "payload log file path (log.payload_log) to restore the masked tokens and content from. It can be given multiple times and can be a glob pattern")
+	since := flag.String("since", "", "recover push notifications accepted at or after the time (RFC3339)")
+	until := flag.String("until", "", "recover push notifications accepted before the time (RFC3339)")
+	platform := flag.String("platform", "", "recover push notifications only for the platform (ios or android)")
+	identifier := flag.String("identifier", "", "recover push notifications only with the identifier")
+	dryRun := flag.Bool("dry-run", false, "print push notifications to recover as JSON without sending them")
+	concurrency := flag.Int("concurrency", 10, "maximum number of push notifications sent concurrently")
+	rate := flag.Float64("rate", 0, "maximum number of push notifications sent per second (0 means unlimited)")
+	resultsPath := flag.String("results", "", "results log file path. Push notifications succeeded in it are skipped")
 	flag.Parse()
 
 	if *versionPrinted {
@@ -87,127 +159,152 @@ func main() {
 		os.Exit(0)
 	}
 
-	// set default parameters
-	gaurun.ConfGaurun = gaurun.BuildDefaultConf()
+	f := &filter{
+		since:      parseTimeFlag("since", *since),
+		until:      parseTimeFlag("until", *until),
+		platform:   *platform,
+		identifier: *identifier,
+	}
+	if f.platform != "" && f.platform != "ios" && f.platform != "android" {
+		gaurun.LogSetupFatal(fmt.Errorf("-platform must be ios or android"))
+	}
+	if *concurrency <= 0 {
+		gaurun.LogSetupFatal(fmt.Errorf("-concurrency must be greater than 0"))
+	}
 
-	// load configuration
-	conf, err := gaurun.LoadConf(gaurun.ConfGaurun, *confPath)
+	// load configuration in the same way as gaurun
+	conf, err := gaurun.BuildConf(*confPath, os.LookupEnv)
+	if err != nil {
+		gaurun.LogSetupFatal(err)
+	}
+	conf, err = gaurun.LoadConfSecretFiles(conf)
 	if err != nil {
 		gaurun.LogSetupFatal(err)
 	}
 	gaurun.ConfGaurun = conf
 
-	f, err := os.Open(*logPath)
+	paths, err := expandLogPaths(logPaths)
 	if err != nil {
-		panic(err)
+		gaurun.LogSetupFatal(err)
+	}
+	finder := newLostFinder()
+	for _, path := range paths {
+		if err := eachLogPushEntry(path, finder.add); err != nil {
+			gaurun.LogSetupFatal(err)
+		}
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	accepts := make(map[uint64]gaurun.LogPushEntry)
-	successes := make(map[uint64]gaurun.LogPushEntry)
 
-	for scanner.Scan() {
-		var logPush gaurun.LogPushEntry
-		line := scanner.Text()
-		err := json.Unmarshal([]byte(line), &logPush)
+	// skip push notifications succeeded on the previous runs
+	succeeded := make(map[resultKey]bool)
+	if *resultsPath != "" {
+		succeeded, err = readSucceededResults(*resultsPath)
 		if err != nil {
-			log.Printf("JSON parse error(%s)", line)
-			continue
+			gaurun.LogSetupFatal(err)
 		}
-		if logPush.Type == "accepted-request" {
+	}
+
+	var lostEntries []gaurun.LogPushEntry
+	for _, logPush := range finder.result() {
+		if succeeded[resultKey{logPush.ID, logPush.Token}] || !f.match(logPush) {
 			continue
 		}
+		lostEntries = append(lostEntries, logPush)
+	}
+
+	// the access logs may have the tokens and the content masked
+	if len(payloadPaths) > 0 {
+		paths, err := expandLogPaths(payloadPaths)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		payloads, err := readPayloads(paths, lostEntries)
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		restored := lostEntries[:0]
+		for _, logPush := range lostEntries {
+			payload, ok := lookupPayload(payloads, logPush)
+			if !ok {
+				log.Printf("no payload for push notification(%d %s)", logPush.ID, logPush.Token)
+				continue
+			}
+			restored = append(restored, payload)
+		}
+		lostEntries = restored
+	}
 
-		switch logPush.Type {
-		case "accepted-push":
-			accepts[logPush.ID] = logPush
-		case "succeeded-push":
-			successes[logPush.ID] = logPush
+	var losts []gaurun.RequestGaurunNotification
+	for _, logPush := range lostEntries {
+		req, err := logPush.Request()
+		if err != nil {
+			log.Printf("invalid log entry(%d): %v", logPush.ID, err)
+			continue
 		}
+		losts = append(losts, req)
 	}
 
-	losts := make(map[uint64]gaurun.LogPushEntry)
-	for id, logPush := range accepts {
-		if _, ok := successes[id]; !ok {
-			losts[id] = logPush
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for _, req := range losts {
+			if err := enc.Encode(req); err != nil {
+				gaurun.LogSetupFatal(err)
+			}
 		}
+		return
 	}
 
-	if gaurun.ConfGaurun.Ios.IsCertificateBasedProvider() {
-		APNSClient, err = gaurun.NewApnsClientHttp2(
-			gaurun.ConfGaurun.Ios.PemCertPath,
-			gaurun.ConfGaurun.Ios.PemKeyPath,
-			gaurun.ConfGaurun.Ios.PemKeyPassphrase,
-		)
-	} else if gaurun.ConfGaurun.Ios.IsTokenBasedProvider() {
-		var authKey *ecdsa.PrivateKey
-		authKey, err = token.AuthKeyFromFile(gaurun.ConfGaurun.Ios.TokenAuthKeyPath)
-		if err != nil {
+	if gaurun.ConfGaurun.Ios.Enabled {
+		if err := gaurun.InitAPNSClient(); err != nil {
 			gaurun.LogSetupFatal(err)
 		}
-		APNSClient, err = gaurun.NewApnsClientHttp2ForToken(
-			authKey,
-			gaurun.ConfGaurun.Ios.TokenAuthKeyID,
-			gaurun.ConfGaurun.Ios.TokenAuthTeamID,
-		)
-	} else {
-		gaurun.LogSetupFatal(fmt.Errorf("should be specify Token-based provider or Certificate-based provider"))
+		APNSClient = gaurun.APNSClient
+		APNSClient.HTTPClient.Timeout = time.Duration(gaurun.ConfGaurun.Ios.Timeout) * time.Second
 	}
-	if err != nil {
-		gaurun.LogSetupFatal(err)
-	}
-	APNSClient.HTTPClient.Timeout = time.Duration(gaurun.ConfGaurun.Ios.Timeout) * time.Second
 
-	GCMClient, err := gcm.NewClient(gcm.FCMSendEndpoint, gaurun.ConfGaurun.Android.ApiKey)
-	if err != nil {
-		gaurun.LogSetupFatal(err)
+	if gaurun.ConfGaurun.Android.Enabled {
+		if err := gaurun.InitGCMClient(); err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		GCMClient = gaurun.GCMClient
 	}
 
-	TransportGCM := &http.Transport{
-		MaxIdleConnsPerHost: gaurun.ConfGaurun.Android.KeepAliveConns,
-		Dial: (&net.Dialer{
-			Timeout:   time.Duration(gaurun.ConfGaurun.Android.Timeout) * time.Second,
-			KeepAlive: time.Duration(gaurun.ConfGaurun.Android.KeepAliveTimeout) * time.Second,
-		}).Dial,
+	var results *zap.Logger
+	if *resultsPath != "" {
+		// the results log is read by the next run, so it does not follow
+		// the format and the rotation in the configuration.
+		results, _, err = gaurun.InitJSONLog(*resultsPath, "info")
+		if err != nil {
+			gaurun.LogSetupFatal(err)
+		}
+		defer results.Sync()
 	}
 
-	GCMClient.Http = &http.Client{
-		Transport: TransportGCM,
-		Timeout:   time.Duration(gaurun.ConfGaurun.Android.Timeout) * time.Second,
+	var throttle <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		throttle = ticker.C
 	}
 
+	reqs := make(chan gaurun.RequestGaurunNotification)
 	wg := new(sync.WaitGroup)
-	for _, logPush := range losts {
-		tokens := make([]string, 1)
-		var platform int
-		tokens[0] = logPush.Token
-		switch logPush.Platform {
-		case "ios":
-			platform = 1
-		case "android":
-			platform = 2
-
-		}
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range reqs {
+				recoverNotification(req, results)
+			}
+		}()
+	}
 
-		req := gaurun.RequestGaurunNotification{
-			Tokens:           tokens,
-			Platform:         platform,
-			Message:          logPush.Message,
-			CollapseKey:      logPush.CollapseKey,
-			DelayWhileIdle:   logPush.DelayWhileIdle,
-			TimeToLive:       logPush.TimeToLive,
-			Title:            logPush.Title,
-			Subtitle:         logPush.Subtitle,
-			Badge:            logPush.Badge,
-			Category:         logPush.Category,
-			Sound:            logPush.Sound,
-			ContentAvailable: logPush.ContentAvailable,
-			Expiry:           logPush.Expiry,
+	for _, req := range losts {
+		if throttle != nil {
+			<-throttle
 		}
-		wg.Add(1)
-		go pushNotification(wg, req, logPush)
+		reqs <- req
 	}
+	close(reqs)
 
 	wg.Wait()
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mercari/gaurun/gaurun"
+)
+
+// stringsFlag is a flag which can be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// expandLogPaths expands the glob patterns and sorts the files in order of
+// modification time so that the rotated logs are read before the current one.
+func expandLogPaths(patterns []string) ([]string, error) {
+	type logFile struct {
+		path string
+		info os.FileInfo
+	}
+
+	seen := make(map[string]bool)
+	var files []logFile
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no log file matches %s", pattern)
+		}
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, logFile{path: path, info: info})
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths, nil
+}
+
+// eachLogPushEntry calls fn with each log of push notification in the file.
+// The file is decompressed if its name ends with .gz.
+func eachLogPushEntry(path string, fn func(gaurun.LogPushEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// bufio.Reader has no limit of the line length unlike bufio.Scanner
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var logPush gaurun.LogPushEntry
+			if parseErr := unmarshalLogLine(line, &logPush); parseErr != nil {
+				log.Printf("parse error(%s)", strings.TrimSpace(string(line)))
+			} else {
+				fn(logPush)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+// unmarshalLogLine parses the line of the log written in JSON or LTSV
+// (log.format = "ltsv").
+func unmarshalLogLine(line []byte, logPush *gaurun.LogPushEntry) error {
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '{' {
+		return json.Unmarshal(line, logPush)
+	}
+	return gaurun.UnmarshalLTSV(line, logPush)
+}
+
+// lostFinder finds the push notifications which were accepted but did not
+// succeed. The logs must be given in order of time. It holds only the
+// notifications in flight, so the memory does not grow with the size of logs.
+type lostFinder struct {
+	pending map[uint64]gaurun.LogPushEntry
+	losts   []gaurun.LogPushEntry
+}
+
+func newLostFinder() *lostFinder {
+	return &lostFinder{pending: make(map[uint64]gaurun.LogPushEntry)}
+}
+
+func (l *lostFinder) add(logPush gaurun.LogPushEntry) {
+	switch logPush.Type {
+	case gaurun.StatusAcceptedPush:
+		// The ID is numbered again after Gaurun restarts, so the notification
+		// accepted with the same ID before was lost in the restart.
+		if prev, ok := l.pending[logPush.ID]; ok {
+			l.losts = append(l.losts, prev)
+		}
+		l.pending[logPush.ID] = logPush
+	case gaurun.StatusSucceededPush, gaurun.StatusDryRunPush, gaurun.StatusSavedPush:
+		// the saved notification is accepted again with a new ID on restart
+		if prev, ok := l.pending[logPush.ID]; ok && prev.Token == logPush.Token {
+			delete(l.pending, logPush.ID)
+		}
+	}
+}
+
+// result returns the lost notifications.
+func (l *lostFinder) result() []gaurun.LogPushEntry {
+	ids := make([]uint64, 0, len(l.pending))
+	for id := range l.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	losts := l.losts
+	for _, id := range ids {
+		losts = append(losts, l.pending[id])
+	}
+	return losts
+}
+
+// resultKey identifies the push notification in the logs. The token is
+// masked as in the logs.
+type resultKey struct {
+	id    uint64
+	token string
+}
+
+// readSucceededResults returns the push notifications succeeded in the results log.
+func readSucceededResults(path string) (map[resultKey]bool, error) {
+	succeeded := make(map[resultKey]bool)
+	err := eachLogPushEntry(path, func(logPush gaurun.LogPushEntry) {
+		if logPush.Type == gaurun.StatusSucceededPush || logPush.Type == gaurun.StatusDryRunPush {
+			succeeded[resultKey{logPush.ID, logPush.Token}] = true
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return succeeded, nil
+}
+
+// readPayloads reads the payload logs written by Gaurun with log.payload_log
+// and returns the entries for the lost push notifications. Only the entries
+// in question are kept, keyed as in the access logs.
+func readPayloads(paths []string, losts []gaurun.LogPushEntry) (map[resultKey][]gaurun.LogPushEntry, error) {
+	wanted := make(map[resultKey]bool, len(losts))
+	for _, logPush := range losts {
+		wanted[resultKey{logPush.ID, logPush.Token}] = true
+	}
+
+	payloads := make(map[resultKey][]gaurun.LogPushEntry)
+	for _, path := range paths {
+		err := eachLogPushEntry(path, func(logPush gaurun.LogPushEntry) {
+			if logPush.Type != gaurun.StatusAcceptedPush {
+				return
+			}
+			key := resultKey{logPush.ID, gaurun.MaskToken(logPush.Token)}
+			if wanted[key] {
+				payloads[key] = append(payloads[key], logPush)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payloads, nil
+}
+
+// lookupPayload returns the entry in the payload logs for the lost push
+// notification. The ID is numbered again after Gaurun restarts, so the one
+// logged at the closest time is chosen if there are several.
+func lookupPayload(payloads map[resultKey][]gaurun.LogPushEntry, lost gaurun.LogPushEntry) (gaurun.LogPushEntry, bool) {
+	candidates := payloads[resultKey{lost.ID, lost.Token}]
+	if len(candidates) == 0 {
+		return gaurun.LogPushEntry{}, false
+	}
+
+	lostTime, err := gaurun.ParseLogTime(lost.Time)
+	if err != nil {
+		return candidates[0], true
+	}
+	best, bestDiff := candidates[0], time.Duration(math.MaxInt64)
+	for _, candidate := range candidates {
+		t, err := gaurun.ParseLogTime(candidate.Time)
+		if err != nil {
+			continue
+		}
+		diff := t.Sub(lostTime)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < bestDiff {
+			best, bestDiff = candidate, diff
+		}
+	}
+	return best, true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mercari/gaurun/gaurun"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func logLines(t *testing.T, entries ...gaurun.LogPushEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		require.NoError(t, err)
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func TestFindLostsAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	accepted := func(id uint64, token string) gaurun.LogPushEntry {
+		return gaurun.LogPushEntry{Type: gaurun.StatusAcceptedPush, ID: id, Platform: "ios", Token: token}
+	}
+	succeeded := func(id uint64, token string) gaurun.LogPushEntry {
+		return gaurun.LogPushEntry{Type: gaurun.StatusSucceededPush, ID: id, Platform: "ios", Token: token}
+	}
+
+	// rotated and gzipped log
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write(logLines(t, accepted(1, "a"), accepted(2, "b"), succeeded(1, "a")))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	rotated := filepath.Join(dir, "access.log.1.gz")
+	require.NoError(t, ioutil.WriteFile(rotated, gz.Bytes(), 0600))
+
+	// current log. Gaurun restarted and numbered the ID 2 again.
+	long := accepted(3, "c")
+	long.Message = strings.Repeat("x", 100*1024)
+	current := filepath.Join(dir, "access.log")
+	require.NoError(t, ioutil.WriteFile(current, logLines(t, long, accepted(2, "d"), succeeded(3, "c"), accepted(4, "e")), 0600))
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(rotated, old, old))
+
+	paths, err := expandLogPaths([]string{filepath.Join(dir, "access.log*"), current})
+	require.NoError(t, err)
+	assert.Equal(t, []string{rotated, current}, paths)
+
+	finder := newLostFinder()
+	for _, path := range paths {
+		require.NoError(t, eachLogPushEntry(path, finder.add))
+	}
+	var tokens []string
+	for _, logPush := range finder.result() {
+		tokens = append(tokens, logPush.Token)
+	}
+	assert.Equal(t, []string{"b", "d", "e"}, tokens)
+
+	_, err = expandLogPaths([]string{filepath.Join(dir, "missing.log")})
+	assert.Error(t, err)
+}
+
+func TestFindLostsSkipsSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	entries := []gaurun.LogPushEntry{
+		{Type: gaurun.StatusAcceptedPush, ID: 1, Platform: "ios", Token: "a"},
+		{Type: gaurun.StatusAcceptedPush, ID: 2, Platform: "ios", Token: "b"},
+		// saved on shutdown, and restored with the ID 1 on the next start
+		{Type: gaurun.StatusSavedPush, ID: 1, Platform: "ios", Token: "a"},
+		{Type: gaurun.StatusSavedPush, ID: 2, Platform: "ios", Token: "b"},
+		{Type: gaurun.StatusAcceptedPush, ID: 1, Platform: "ios", Token: "a"},
+		{Type: gaurun.StatusAcceptedPush, ID: 2, Platform: "ios", Token: "b"},
+		{Type: gaurun.StatusSucceededPush, ID: 1, Platform: "ios", Token: "a"},
+	}
+	require.NoError(t, ioutil.WriteFile(path, logLines(t, entries...), 0600))
+
+	finder := newLostFinder()
+	require.NoError(t, eachLogPushEntry(path, finder.add))
+	losts := finder.result()
+	require.Len(t, losts, 1)
+	assert.Equal(t, "b", losts[0].Token)
+}
+
+func TestReadSucceededResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.log")
+
+	succeeded, err := readSucceededResults(path)
+	require.NoError(t, err)
+	assert.Empty(t, succeeded)
+
+	require.NoError(t, ioutil.WriteFile(path, logLines(t,
+		gaurun.LogPushEntry{Type: gaurun.StatusSucceededPush, ID: 1, Token: "a"},
+		gaurun.LogPushEntry{Type: gaurun.StatusFailedPush, ID: 2, Token: "b"},
+		gaurun.LogPushEntry{Type: gaurun.StatusDryRunPush, ID: 3, Token: "c"},
+	), 0600))
+	succeeded, err = readSucceededResults(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[resultKey]bool{{1, "a"}: true, {3, "c"}: true}, succeeded)
+}
+
+func TestReadPayloads(t *testing.T) {
+	logBefore := gaurun.ConfGaurun.Log
+	defer func() {
+		gaurun.ConfGaurun.Log = logBefore
+	}()
+	gaurun.ConfGaurun.Log.TokenMask = gaurun.LogTokenMaskTruncate
+	gaurun.ConfGaurun.Log.Content = gaurun.LogContentOmit
+
+	token := strings.Repeat("0123abcd", 8)
+	at := func(d time.Duration) string {
+		return time.Now().Add(d).Format(gaurun.LogTimeLayout)
+	}
+	payload := func(id uint64, message, logTime string) gaurun.LogPushEntry {
+		return gaurun.LogPushEntry{Type: gaurun.StatusAcceptedPush, ID: id, Platform: "ios", Token: token, Message: message, Time: logTime}
+	}
+
+	// Gaurun restarted and numbered the ID 1 again.
+	path := filepath.Join(t.TempDir(), "payload.log")
+	require.NoError(t, ioutil.WriteFile(path, logLines(t,
+		payload(1, "old", at(-time.Hour)),
+		payload(2, "other", at(-time.Hour)),
+		payload(1, "new", at(0)),
+		gaurun.LogPushEntry{Type: gaurun.StatusSucceededPush, ID: 1, Platform: "ios", Token: token, Message: "new"},
+	), 0600))
+
+	losts := []gaurun.LogPushEntry{
+		{Type: gaurun.StatusAcceptedPush, ID: 1, Platform: "ios", Token: gaurun.MaskToken(token), Time: at(0)},
+		{Type: gaurun.StatusAcceptedPush, ID: 3, Platform: "ios", Token: gaurun.MaskToken(token), Time: at(0)},
+	}
+	payloads, err := readPayloads([]string{path}, losts)
+	require.NoError(t, err)
+	assert.Len(t, payloads, 1)
+
+	restored, ok := lookupPayload(payloads, losts[0])
+	require.True(t, ok)
+	assert.Equal(t, token, restored.Token)
+	assert.Equal(t, "new", restored.Message)
+
+	_, ok = lookupPayload(payloads, losts[1])
+	assert.False(t, ok)
+}
+
+func TestEachLogPushEntryLTSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte(
+		"level:info\ttime:2021/10/01 10:00:00 +0900\tmessage:hello\\tworld\tid:1\tplatform:ios\ttoken:a\ttype:accepted-push\tptime:0\terror:\tbadge:1\n"+
+			"level:info\ttime:2021/10/01 10:00:01 +0900\ttype:completed-request\tstatus:200\n"+
+			`{"type":"accepted-push","id":2,"platform":"android","token":"b"}`+"\n",
+	), 0600))
+
+	var entries []gaurun.LogPushEntry
+	require.NoError(t, eachLogPushEntry(path, func(logPush gaurun.LogPushEntry) {
+		entries = append(entries, logPush)
+	}))
+	require.Len(t, entries, 3)
+	assert.Equal(t, gaurun.LogPushEntry{
+		Type:     gaurun.StatusAcceptedPush,
+		Time:     "2021/10/01 10:00:00 +0900",
+		ID:       1,
+		Platform: "ios",
+		Token:    "a",
+		Message:  "hello\tworld",
+		Badge:    1,
+	}, entries[0])
+	assert.Equal(t, "completed-request", entries[1].Type)
+	assert.Equal(t, "b", entries[2].Token)
+}
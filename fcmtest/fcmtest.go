@@ -0,0 +1,283 @@
+// Package fcmtest provides a fake FCM for tests.
+//
+// The fake accepts the legacy HTTP protocol of FCM, validates the request
+// like FCM does, records the received messages and responds the scripted
+// failures.
+package fcmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mercari/gaurun/gcm"
+)
+
+const (
+	// MaxPayload is the maximum size of data payload in bytes.
+	MaxPayload = 4096
+	// MaxRegistrationIDs is the maximum number of registration IDs in a message.
+	MaxRegistrationIDs = 1000
+	// MaxTimeToLive is the maximum time_to_live in seconds.
+	MaxTimeToLive = 2419200
+)
+
+// Message is a message received by Handler.
+type Message struct {
+	Header     http.Header `json:"header"`
+	Message    gcm.Message `json:"message"`
+	ReceivedAt time.Time   `json:"received_at"`
+}
+
+// Failure is a scripted failure of Handler.
+type Failure struct {
+	// Status is responded as the HTTP status of FCM (e.g. 429 or 500)
+	// instead of the results. It is ignored if it is 0.
+	Status int `json:"status"`
+	// RetryAfter is set to the Retry-After header with Status in seconds.
+	RetryAfter int `json:"retry_after"`
+	// Error is responded as the error of the results (e.g. "NotRegistered").
+	Error string `json:"error"`
+	// Delay makes the response slow.
+	Delay time.Duration `json:"delay"`
+	// Reset closes the connection instead of responding.
+	Reset bool `json:"reset"`
+}
+
+// Handler is the fake FCM.
+type Handler struct {
+	// APIKey verifies the Authorization header if set.
+	APIKey string
+
+	mu            sync.Mutex
+	messages      []Message
+	failures      []Failure
+	tokenFailures map[string]Failure
+	seq           int64
+}
+
+// NewHandler returns a fake FCM.
+func NewHandler() *Handler {
+	return &Handler{tokenFailures: make(map[string]Failure)}
+}
+
+// FailNext makes the next requests fail in order.
+func (h *Handler) FailNext(failures ...Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = append(h.failures, failures...)
+}
+
+// FailToken makes every request to the registration ID fail.
+// With Error, only the result of the registration ID fails.
+func (h *Handler) FailToken(registrationID string, failure Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokenFailures[registrationID] = failure
+}
+
+// Messages returns the messages received successfully.
+func (h *Handler) Messages() []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Message{}, h.messages...)
+}
+
+// Reset clears the received messages and the scripted failures.
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = nil
+	h.failures = nil
+	h.tokenFailures = make(map[string]Failure)
+}
+
+func (h *Handler) nextFailure(registrationIDs []string) (Failure, map[string]string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.failures) > 0 {
+		f := h.failures[0]
+		h.failures = h.failures[1:]
+		return f, nil, true
+	}
+
+	var (
+		failure Failure
+		found   bool
+		errs    = make(map[string]string)
+	)
+	for _, id := range registrationIDs {
+		f, ok := h.tokenFailures[id]
+		if !ok {
+			continue
+		}
+		if f.Error != "" {
+			errs[id] = f.Error
+		}
+		if !found && (f.Status != 0 || f.Delay > 0 || f.Reset) {
+			failure = f
+			found = true
+		}
+	}
+	failure.Error = ""
+	return failure, errs, found || len(errs) > 0
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, message)
+}
+
+// validate checks the request like FCM and returns the status and the message of the error.
+func (h *Handler) validate(r *http.Request) (int, string) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, "method must be POST"
+	}
+	if h.APIKey != "" && r.Header.Get("Authorization") != "key="+h.APIKey {
+		return http.StatusUnauthorized, "Unauthorized"
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusBadRequest, "Content-Type must be application/json"
+	}
+	return 0, ""
+}
+
+// validateMessage checks the message and returns the error for every result.
+func validateMessage(msg *gcm.Message) (string, error) {
+	if msg.RegistrationIDs == nil {
+		return "", fmt.Errorf("Missing \"registration_ids\" field")
+	}
+	if len(msg.RegistrationIDs) == 0 {
+		return "", fmt.Errorf("Request contains an empty \"registration_ids\" field")
+	}
+	if len(msg.RegistrationIDs) > MaxRegistrationIDs {
+		return "", fmt.Errorf("Number of messages on bulk (%d) exceeds maximum allowed (%d)", len(msg.RegistrationIDs), MaxRegistrationIDs)
+	}
+	if msg.Priority != "" && msg.Priority != "high" && msg.Priority != "normal" {
+		return "", fmt.Errorf("Invalid \"priority\" field: %s", msg.Priority)
+	}
+	if msg.TimeToLive < 0 || msg.TimeToLive > MaxTimeToLive {
+		return "InvalidTtl", nil
+	}
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return "", err
+	}
+	if msg.Data != nil && len(data) > MaxPayload {
+		return "MessageTooBig", nil
+	}
+	return "", nil
+}
+
+func isRegistrationIDValid(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("-_:.", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status, message := h.validate(r); status != 0 {
+		writeError(w, status, message)
+		return
+	}
+
+	var msg gcm.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("JSON_PARSING_ERROR: %v", err))
+		return
+	}
+
+	failure, tokenErrors, ok := h.nextFailure(msg.RegistrationIDs)
+	if ok {
+		if failure.Delay > 0 {
+			select {
+			case <-time.After(failure.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if failure.Reset {
+			panic(http.ErrAbortHandler)
+		}
+		if failure.Status != 0 {
+			if failure.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(failure.RetryAfter))
+			}
+			writeError(w, failure.Status, http.StatusText(failure.Status))
+			return
+		}
+	}
+
+	messageError, err := validateMessage(&msg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	multicastID := atomic.AddInt64(&h.seq, 1)
+	resp := gcm.Response{MulticastID: multicastID}
+	succeeded := false
+	for i, id := range msg.RegistrationIDs {
+		var result gcm.Result
+		switch {
+		case messageError != "":
+			result.Error = messageError
+		case failure.Error != "":
+			result.Error = failure.Error
+		case tokenErrors[id] != "":
+			result.Error = tokenErrors[id]
+		case id == "":
+			result.Error = "MissingRegistration"
+		case !isRegistrationIDValid(id):
+			result.Error = "InvalidRegistration"
+		default:
+			result.MessageID = fmt.Sprintf("0:%d%%%d", multicastID, i)
+			succeeded = true
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if succeeded {
+		h.mu.Lock()
+		h.messages = append(h.messages, Message{
+			Header:     r.Header.Clone(),
+			Message:    msg,
+			ReceivedAt: time.Now(),
+		})
+		h.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Server is a fake FCM listening on HTTP.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a fake FCM. The caller should call Close when finished.
+// The URL of the server is the endpoint to send messages to.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{Server: httptest.NewServer(h), Handler: h}
+}
@@ -0,0 +1,112 @@
+package fcmtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mercari/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T, s *Server, apiKey string) *gcm.Client {
+	client, err := gcm.NewClient(s.URL, apiKey)
+	require.NoError(t, err)
+	return client
+}
+
+func TestServerSend(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.APIKey = "apikey"
+
+	resp, err := newClient(t, s, "apikey").Send(gcm.NewMessage(map[string]interface{}{"message": "hello"}, "token1", "token2"))
+	require.NoError(t, err)
+	require.Len(t, resp.Results, 2)
+	for _, result := range resp.Results {
+		assert.NotEmpty(t, result.MessageID)
+		assert.Empty(t, result.Error)
+	}
+
+	messages := s.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, []string{"token1", "token2"}, messages[0].Message.RegistrationIDs)
+	assert.Equal(t, "hello", messages[0].Message.Data["message"])
+	assert.Equal(t, "key=apikey", messages[0].Header.Get("Authorization"))
+
+	s.Reset()
+	assert.Empty(t, s.Messages())
+}
+
+func TestServerValidate(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.APIKey = "apikey"
+
+	_, err := newClient(t, s, "wrong").Send(gcm.NewMessage(nil, "token"))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, err.(*gcm.StatusError).StatusCode)
+
+	// gcm.Client checks the size of data payload by itself, so the request is sent directly.
+	body := `{"registration_ids":["token"],"data":{"message":"` + strings.Repeat("a", MaxPayload) + `"}}`
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "key=apikey")
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var resp gcm.Response
+	require.NoError(t, json.NewDecoder(httpResp.Body).Decode(&resp))
+	httpResp.Body.Close()
+	assert.Equal(t, "MessageTooBig", resp.Results[0].Error)
+
+	sent, err := newClient(t, s, "apikey").Send(gcm.NewMessage(nil, "token", "invalid token"))
+	require.NoError(t, err)
+	assert.Empty(t, sent.Results[0].Error)
+	assert.Equal(t, "InvalidRegistration", sent.Results[1].Error)
+
+	assert.Len(t, s.Messages(), 1)
+}
+
+func TestServerFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := newClient(t, s, "apikey")
+	msg := gcm.NewMessage(nil, "token1", "token2")
+
+	s.FailNext(
+		Failure{Status: http.StatusTooManyRequests, RetryAfter: 10},
+		Failure{Status: http.StatusInternalServerError},
+		Failure{Error: "Unavailable"},
+	)
+	_, err := client.Send(msg)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, err.(*gcm.StatusError).StatusCode)
+	_, err = client.Send(msg)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, err.(*gcm.StatusError).StatusCode)
+	resp, err := client.Send(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "Unavailable", resp.Results[0].Error)
+	assert.Equal(t, "Unavailable", resp.Results[1].Error)
+
+	s.FailToken("token2", Failure{Error: "NotRegistered"})
+	resp, err = client.Send(msg)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Results[0].Error)
+	assert.Equal(t, "NotRegistered", resp.Results[1].Error)
+
+	s.FailNext(Failure{Reset: true})
+	_, err = client.Send(msg)
+	assert.Error(t, err)
+
+	s.FailNext(Failure{Delay: time.Second})
+	client.Http = &http.Client{Timeout: 100 * time.Millisecond}
+	_, err = client.Send(msg)
+	assert.Error(t, err)
+
+	assert.Len(t, s.Messages(), 1)
+}
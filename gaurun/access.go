@@ -0,0 +1,123 @@
+package gaurun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+const (
+	// RequestIDHeader is the header to give and return the request ID.
+	RequestIDHeader = "X-Request-ID"
+	// maxRequestIDLength is the maximum length of the request ID given by
+	// the client. The longer one is replaced with a generated one.
+	maxRequestIDLength = 128
+)
+
+type requestInfoKey struct{}
+
+// requestInfo is shared between withAccessLog and the handler to log the
+// request on completion.
+type requestInfo struct {
+	id            string
+	notifications int
+	// principal is the authenticated client, empty if not authenticated
+	principal string
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestIDFrom returns the ID of the request handled with withAccessLog.
+func requestIDFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// principalFrom returns the principal who sent the request handled with
+// withAccessLog.
+func principalFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil && info.principal != "" {
+		return info.principal
+	}
+	return anonymousPrincipal
+}
+
+// accessRecorder records the status and the size of the response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *accessRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// withAccessLog assigns the request ID to the request and logs it on
+// completion. The ID is taken from X-Request-ID if the client gives a valid
+// one and is returned in the response header.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stime := time.Now()
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set(RequestIDHeader, info.id)
+
+		rec := &accessRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		LogCompletedRequest(r, info.id, rec.status, rec.size, time.Since(stime).Seconds(), info.notifications)
+	})
+}
+
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); isRequestIDValid(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+func isRequestIDValid(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// the ID is not worth failing the request
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	id := requestID(r)
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, id, requestID(r))
+
+	r.Header.Set(RequestIDHeader, "f47ac10b-58cc-4372-a567-0e02b2c3d479")
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", requestID(r))
+
+	for _, invalid := range []string{"id with spaces", "id\nwith\nnewlines", strings.Repeat("a", maxRequestIDLength+1)} {
+		r.Header.Set(RequestIDHeader, invalid)
+		assert.NotEqual(t, invalid, requestID(r))
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	confBefore := ConfGaurun
+	queueBefore := QueueNotification
+	accessBefore := LogAccess
+	defer func() {
+		ConfGaurun = confBefore
+		QueueNotification = queueBefore
+		LogAccess = accessBefore
+	}()
+	ConfGaurun = BuildDefaultConf()
+	QueueNotification = make(chan RequestGaurunNotification, 10)
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	var err error
+	LogAccess, _, err = InitLog(path, "info")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+
+	token := strings.Repeat("0123abcd", 8)
+	r := httptest.NewRequest("POST", "/push", strings.NewReader(`{"notifications":[{"token":["`+token+`"],"platform":1,"message":"hello"}]}`))
+	r.Header.Set(RequestIDHeader, "request-1")
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "request-1", w.Header().Get(RequestIDHeader))
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/push", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	generatedID := w.Header().Get(RequestIDHeader)
+	assert.NotEmpty(t, generatedID)
+
+	req := <-QueueNotification
+	assert.Equal(t, "request-1", req.RequestID)
+	enqueueWg.Wait()
+	require.NoError(t, LogAccess.Sync())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var (
+		completed []LogReq
+		pushes    []LogPushEntry
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry struct {
+			Type string `json:"type"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		switch entry.Type {
+		case "completed-request":
+			var logReq LogReq
+			require.NoError(t, json.Unmarshal([]byte(line), &logReq))
+			completed = append(completed, logReq)
+		case StatusAcceptedPush:
+			var logPush LogPushEntry
+			require.NoError(t, json.Unmarshal([]byte(line), &logPush))
+			pushes = append(pushes, logPush)
+		}
+	}
+
+	require.Len(t, completed, 2)
+	assert.Equal(t, "request-1", completed[0].RequestID)
+	assert.Equal(t, "/push", completed[0].URI)
+	assert.Equal(t, "192.0.2.1", completed[0].XForwardedFor)
+	assert.NotEmpty(t, completed[0].RemoteAddr)
+	assert.Equal(t, http.StatusOK, completed[0].Status)
+	assert.Equal(t, int64(len(`{"message":"ok"}`+"\n")), completed[0].Size)
+	assert.Equal(t, 1, completed[0].Notifications)
+	assert.Equal(t, generatedID, completed[1].RequestID)
+	assert.Equal(t, http.StatusBadRequest, completed[1].Status)
+	assert.Zero(t, completed[1].Notifications)
+
+	require.Len(t, pushes, 1)
+	assert.Equal(t, "request-1", pushes[0].RequestID)
+}
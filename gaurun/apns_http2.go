@@ -1,15 +1,17 @@
 package gaurun
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/mercari/gaurun/buford/payload"
@@ -22,11 +24,35 @@ type APNsClient struct {
 	HTTPClient *http.Client
 	// Token is set only for token-based provider connection trust
 	Token *token.Token
+	// Certificate is set only for certificate-based provider connection trust
+	Certificate *x509.Certificate
+}
+
+// loadRootCAs loads the CA certificates to verify APNs with.
+// It returns nil to use the system roots if ios.root_ca_path is empty.
+func loadRootCAs() (*x509.CertPool, error) {
+	if ConfGaurun.Ios.RootCAPath == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(ConfGaurun.Ios.RootCAPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate was found in %s", ConfGaurun.Ios.RootCAPath)
+	}
+	return pool, nil
 }
 
 func NewTransportHttp2(cert tls.Certificate) (*http.Transport, error) {
+	rootCAs, err := loadRootCAs()
+	if err != nil {
+		return nil, err
+	}
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
 	}
 	config.BuildNameToCertificate()
 
@@ -45,7 +71,20 @@ func NewTransportHttp2(cert tls.Certificate) (*http.Transport, error) {
 }
 
 func NewApnsClientHttp2(certPath, keyPath, keyPassphrase string) (APNsClient, error) {
-	cert, err := loadX509KeyPairWithPassword(certPath, keyPath, keyPassphrase)
+	cert, err := LoadApnsCertificate(&SectionIos{
+		PemCertPath:      certPath,
+		PemKeyPath:       keyPath,
+		PemKeyPassphrase: keyPassphrase,
+	})
+	if err != nil {
+		return APNsClient{}, err
+	}
+
+	return NewApnsClientHttp2ForCertificate(cert)
+}
+
+func NewApnsClientHttp2ForCertificate(cert tls.Certificate) (APNsClient, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
 		return APNsClient{}, err
 	}
@@ -60,6 +99,7 @@ func NewApnsClientHttp2(certPath, keyPath, keyPassphrase string) (APNsClient, er
 			Transport: transport,
 			Timeout:   time.Duration(ConfGaurun.Ios.Timeout) * time.Second,
 		},
+		Certificate: leaf,
 	}, nil
 }
 
@@ -70,7 +110,13 @@ func NewApnsClientHttp2ForToken(authKey *ecdsa.PrivateKey, keyID, teamID string)
 		TeamID:  teamID,
 	}
 
+	rootCAs, err := loadRootCAs()
+	if err != nil {
+		return APNsClient{}, err
+	}
+
 	transport := &http.Transport{
+		TLSClientConfig:     &tls.Config{RootCAs: rootCAs},
 		MaxIdleConnsPerHost: ConfGaurun.Ios.KeepAliveConns,
 		Dial: (&net.Dialer{
 			Timeout:   time.Duration(ConfGaurun.Ios.Timeout) * time.Second,
@@ -89,37 +135,11 @@ func NewApnsClientHttp2ForToken(authKey *ecdsa.PrivateKey, keyID, teamID string)
 	}, nil
 }
 
-func loadX509KeyPairWithPassword(certPath, keyPath, keyPassphrase string) (tls.Certificate, error) {
-	keyPEMBlock, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-	if keyPassphrase != "" {
-		pemBlock, _ := pem.Decode(keyPEMBlock)
-		if !x509.IsEncryptedPEMBlock(pemBlock) {
-			err = fmt.Errorf("%s is not encrypted. passphrase is not required", keyPath)
-			return tls.Certificate{}, err
-		}
-		keyPEMBlock, err = x509.DecryptPEMBlock(pemBlock, []byte(keyPassphrase))
-		if err != nil {
-			return tls.Certificate{}, err
-		}
-		keyPEMBlock = pem.EncodeToMemory(&pem.Block{Type: pemBlock.Type, Bytes: keyPEMBlock})
-	}
-	certPEMBlock, err := ioutil.ReadFile(certPath)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-	return cert, nil
-}
-
 func NewApnsServiceHttp2(apnsClient APNsClient) *push.Service {
 	var host string
-	if ConfGaurun.Ios.Sandbox {
+	if ConfGaurun.Ios.Endpoint != "" {
+		host = ConfGaurun.Ios.Endpoint
+	} else if ConfGaurun.Ios.Sandbox {
 		host = push.Development
 	} else {
 		host = push.Production
@@ -156,14 +176,23 @@ func NewApnsHeadersHttp2(req *RequestGaurunNotification) *push.Headers {
 
 	// Required when delivering notifications to devices running iOS 13 and later, or watchOS 6 and later. Ignored on earlier system versions.
 	// cf: https://developer.apple.com/documentation/usernotifications/setting_up_a_remote_notification_server/sending_notification_requests_to_apns
-	if req.PushType == ApnsPushTypeBackground {
+	topic := ConfGaurun.Ios.Topic
+	switch req.PushType {
+	case ApnsPushTypeBackground:
 		pushType = push.PushTypeBackground
-	} else {
+	case ApnsPushTypeVoIP:
+		pushType = push.PushTypeVoIP
+		// VoIP notifications are sent to the topic with the suffix
+		if topic != "" && !strings.HasSuffix(topic, ".voip") {
+			topic += ".voip"
+		}
+	default:
 		pushType = push.PushTypeAlert
 	}
 
 	headers := &push.Headers{
-		Topic:    ConfGaurun.Ios.Topic,
+		ID:       req.ApnsID,
+		Topic:    topic,
 		PushType: pushType,
 	}
 
@@ -181,11 +210,53 @@ func NewApnsHeadersHttp2WithToken(req *RequestGaurunNotification, t *token.Token
 	return headers
 }
 
-func ApnsPushHttp2(token string, service *push.Service, headers *push.Headers, payload map[string]interface{}) error {
+// ValidateApnsPushHttp2 checks the device token and the size of the payload
+// like APNs does, without sending the push notification.
+func ValidateApnsPushHttp2(token string, headers *push.Headers, payload map[string]interface{}) error {
+	if !push.IsDeviceTokenValid(token) {
+		return &push.Error{Reason: push.ErrBadDeviceToken, Status: http.StatusBadRequest}
+	}
 	b, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	_, err = service.Push(token, headers, b)
+	if len(b) > push.PayloadLimit(headers.PushType) {
+		return &push.Error{Reason: push.ErrPayloadTooLarge, Status: http.StatusRequestEntityTooLarge}
+	}
+	return nil
+}
+
+func ApnsPushHttp2(token string, service *push.Service, headers *push.Headers, payload map[string]interface{}) error {
+	return ApnsPushHttp2WithContext(context.Background(), token, service, headers, payload)
+}
+
+func ApnsPushHttp2WithContext(ctx context.Context, token string, service *push.Service, headers *push.Headers, payload map[string]interface{}) error {
+	_, err := ApnsPushHttp2WithIDContext(ctx, token, service, headers, payload)
 	return err
 }
+
+// ApnsPushHttp2WithID is like ApnsPushHttp2 but returns the apns-id of the
+// push notification.
+func ApnsPushHttp2WithID(token string, service *push.Service, headers *push.Headers, payload map[string]interface{}) (string, error) {
+	return ApnsPushHttp2WithIDContext(context.Background(), token, service, headers, payload)
+}
+
+// ApnsPushHttp2WithIDContext is like ApnsPushHttp2WithContext but returns
+// the apns-id of the push notification.
+func ApnsPushHttp2WithIDContext(ctx context.Context, token string, service *push.Service, headers *push.Headers, payload map[string]interface{}) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return service.PushWithContext(ctx, token, headers, b)
+}
+
+// isApnsID reports whether id is a UUID in the canonical form
+// (e.g. 123e4567-e89b-12d3-a456-426655440000) APNs accepts as apns-id.
+func isApnsID(id string) bool {
+	if len(id) != 36 || id[8] != '-' || id[13] != '-' || id[18] != '-' || id[23] != '-' {
+		return false
+	}
+	_, err := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	return err == nil
+}
@@ -20,3 +20,19 @@ func TestNewApnsClientHttp2(t *testing.T) {
 	headers = NewApnsHeadersHttp2(req)
 	assert.Equal(t, push.PushTypeBackground, headers.PushType)
 }
+
+func TestNewApnsHeadersHttp2VoIP(t *testing.T) {
+	topicBefore := ConfGaurun.Ios.Topic
+	defer func() {
+		ConfGaurun.Ios.Topic = topicBefore
+	}()
+
+	ConfGaurun.Ios.Topic = "com.example.gaurun"
+	headers := NewApnsHeadersHttp2(&RequestGaurunNotification{PushType: ApnsPushTypeVoIP})
+	assert.Equal(t, push.PushTypeVoIP, headers.PushType)
+	assert.Equal(t, "com.example.gaurun.voip", headers.Topic)
+
+	ConfGaurun.Ios.Topic = "com.example.gaurun.voip"
+	headers = NewApnsHeadersHttp2(&RequestGaurunNotification{PushType: ApnsPushTypeVoIP})
+	assert.Equal(t, "com.example.gaurun.voip", headers.Topic)
+}
@@ -0,0 +1,53 @@
+package gaurun
+
+import (
+	"net/http"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// anonymousPrincipal is the principal of the requests not authenticated.
+const anonymousPrincipal = "anonymous"
+
+// LogAdminAction records the administrative action requested with r to the
+// audit log, with the value before and after it. A nil value is omitted.
+func LogAdminAction(r *http.Request, action string, oldValue, newValue interface{}) {
+	xForwardedFor := zap.Skip()
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		xForwardedFor = zap.String("x_forwarded_for", xff)
+	}
+	logAdminAction(action, oldValue, newValue,
+		zap.String("request_id", requestIDFrom(r.Context())),
+		zap.String("remote_addr", r.RemoteAddr),
+		xForwardedFor,
+		zap.String("principal", principalFrom(r.Context())),
+	)
+}
+
+// LogSignalAction records the administrative action triggered by sig, such
+// as the reload on SIGHUP, to the audit log.
+func LogSignalAction(sig os.Signal, action string, oldValue, newValue interface{}) {
+	logAdminAction(action, oldValue, newValue,
+		zap.String("principal", "signal:"+sig.String()),
+	)
+}
+
+func logAdminAction(action string, oldValue, newValue interface{}, fields ...zap.Field) {
+	if LogAudit == nil {
+		return
+	}
+	valueField := func(key string, v interface{}) zap.Field {
+		if v == nil {
+			return zap.Skip()
+		}
+		return zap.Any(key, v)
+	}
+
+	fields = append([]zap.Field{
+		zap.String("type", "admin-action"),
+		zap.String("action", action),
+	}, fields...)
+	fields = append(fields, valueField("old", oldValue), valueField("new", newValue))
+	LogAudit.Info("", fields...)
+}
@@ -0,0 +1,100 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type auditEntry struct {
+	Type          string          `json:"type"`
+	Time          string          `json:"time"`
+	Action        string          `json:"action"`
+	RequestID     string          `json:"request_id"`
+	RemoteAddr    string          `json:"remote_addr"`
+	XForwardedFor string          `json:"x_forwarded_for"`
+	Principal     string          `json:"principal"`
+	Old           json.RawMessage `json:"old"`
+	New           json.RawMessage `json:"new"`
+}
+
+func TestAuditLog(t *testing.T) {
+	confBefore := ConfGaurun
+	auditBefore := LogAudit
+	defer func() {
+		ConfGaurun = confBefore
+		LogAudit = auditBefore
+		pauseAndroid.resume()
+	}()
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Core.PusherMax = 10
+
+	// nothing is recorded without the audit log
+	LogAudit = nil
+	LogSignalAction(syscall.SIGHUP, "reload", nil, nil)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	LogAudit, _, err = InitLog(path, "info")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+
+	r := httptest.NewRequest("PUT", "/config/pushers?max=20", nil)
+	r.Header.Set(RequestIDHeader, "request-1")
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the rejected request is not an action
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/config/pushers?max=-1", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/config/pause?platform=android", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	LogSignalAction(syscall.SIGHUP, "reload", map[string]int64{"workers": 1}, map[string]int64{"workers": 2})
+	require.NoError(t, LogAudit.Sync())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry auditEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "admin-action", entries[0].Type)
+	assert.NotEmpty(t, entries[0].Time)
+	assert.Equal(t, "pushers", entries[0].Action)
+	assert.Equal(t, "request-1", entries[0].RequestID)
+	assert.Equal(t, r.RemoteAddr, entries[0].RemoteAddr)
+	assert.Equal(t, "192.0.2.1", entries[0].XForwardedFor)
+	assert.Equal(t, anonymousPrincipal, entries[0].Principal)
+	assert.JSONEq(t, "10", string(entries[0].Old))
+	assert.JSONEq(t, "20", string(entries[0].New))
+
+	assert.Equal(t, "pause:android", entries[1].Action)
+	assert.JSONEq(t, "false", string(entries[1].Old))
+	assert.JSONEq(t, "true", string(entries[1].New))
+
+	assert.Equal(t, "reload", entries[2].Action)
+	assert.Equal(t, "signal:hangup", entries[2].Principal)
+	assert.Empty(t, entries[2].RemoteAddr)
+	assert.JSONEq(t, `{"workers":1}`, string(entries[2].Old))
+	assert.JSONEq(t, `{"workers":2}`, string(entries[2].New))
+}
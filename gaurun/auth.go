@@ -0,0 +1,381 @@
+package gaurun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// AuthKeyHeader is the header to give the name of the key signing the request.
+	AuthKeyHeader = "X-Gaurun-Key"
+	// AuthTimestampHeader is the header to give the time the request is signed
+	// at in unixtime.
+	AuthTimestampHeader = "X-Gaurun-Timestamp"
+	// AuthNonceHeader is the header to give the value unique to the request
+	// for the key, to tell it from the replayed ones.
+	AuthNonceHeader = "X-Gaurun-Nonce"
+	// AuthSignatureHeader is the header to give the hex-encoded signature.
+	AuthSignatureHeader = "X-Gaurun-Signature"
+)
+
+// APIKey is the key for a client to call the API. The client authenticates
+// with the bearer token or the requests signed with the secret.
+type APIKey struct {
+	Name   string   `toml:"name"`
+	Token  string   `toml:"token"`
+	Secret string   `toml:"secret"`
+	Scopes []string `toml:"scopes"`
+}
+
+// HasScope reports whether the key is allowed to call the API of scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAPIKeys reads the API keys from the file given by auth.keys_file.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []APIKey `toml:"keys"`
+	}
+	if err := toml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no key is defined", path)
+	}
+
+	names := make(map[string]bool, len(file.Keys))
+	tokens := make(map[string]bool, len(file.Keys))
+	for i, key := range file.Keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("%s: keys[%d]: name must be set", path, i)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("%s: keys[%d]: name %q is duplicated", path, i, key.Name)
+		}
+		names[key.Name] = true
+		if key.Token == "" && key.Secret == "" {
+			return nil, fmt.Errorf("%s: keys[%d]: token or secret must be set", path, i)
+		}
+		if key.Token != "" {
+			if tokens[key.Token] {
+				return nil, fmt.Errorf("%s: keys[%d]: token is duplicated", path, i)
+			}
+			tokens[key.Token] = true
+		}
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("%s: keys[%d]: scopes must be set", path, i)
+		}
+		for _, scope := range key.Scopes {
+			switch scope {
+			case AuthScopePush, AuthScopeStat, AuthScopeAdmin:
+			default:
+				return nil, fmt.Errorf("%s: keys[%d]: scope must be one of %s, %s or %s (got %q)", path, i, AuthScopePush, AuthScopeStat, AuthScopeAdmin, scope)
+			}
+		}
+	}
+	return file.Keys, nil
+}
+
+// Authenticator authenticates the requests to the API. Authenticate returns
+// the key of the request, or nil without error if the request has no
+// credentials it handles so that the next authenticator tries.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*APIKey, error)
+}
+
+// AuthError is the error of the request with invalid credentials.
+type AuthError struct {
+	// Key is the name of the key if the request tells one of the loaded
+	// keys. The names given by the clients are not kept as they are not to
+	// grow the counters without limit.
+	Key    string
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("%s (key %q)", e.Reason, e.Key)
+	}
+	return e.Reason
+}
+
+// BearerAuthenticator authenticates the requests with
+// "Authorization: Bearer <token>".
+type BearerAuthenticator struct {
+	keys []APIKey
+}
+
+func NewBearerAuthenticator(keys []APIKey) *BearerAuthenticator {
+	return &BearerAuthenticator{keys: keys}
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request) (*APIKey, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return nil, nil
+	}
+	token := []byte(strings.TrimPrefix(header, prefix))
+
+	var found *APIKey
+	for i := range a.keys {
+		key := &a.keys[i]
+		// compares every key so that the time does not tell which matched
+		if key.Token != "" && subtle.ConstantTimeCompare([]byte(key.Token), token) == 1 {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, &AuthError{Reason: "invalid token"}
+	}
+	return found, nil
+}
+
+// authReasonBodyTooLarge is the reason of the signed request whose body
+// exceeds auth.max_body_size.
+const authReasonBodyTooLarge = "body too large"
+
+// HMACAuthenticator authenticates the requests signed with the secret of the
+// key. The signature is the HMAC-SHA256 of the timestamp, the nonce, the
+// method, the request URI and the body joined with newlines. The requests
+// signed more than maxClockSkew ago or ahead are rejected, and so are the
+// requests with the nonce used within it.
+type HMACAuthenticator struct {
+	keys         map[string]*APIKey
+	maxClockSkew time.Duration
+	// maxBodySize is the size of the body in bytes read to verify the
+	// signature at most
+	maxBodySize int64
+	// nonces is shared with the authenticator replaced by InitAuth
+	nonces *nonceCache
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func NewHMACAuthenticator(keys []APIKey, maxClockSkew time.Duration, maxBodySize int64) *HMACAuthenticator {
+	a := &HMACAuthenticator{
+		keys:         make(map[string]*APIKey, len(keys)),
+		maxClockSkew: maxClockSkew,
+		maxBodySize:  maxBodySize,
+		nonces:       &nonceCache{seen: make(map[authNonce]time.Time)},
+		now:          time.Now,
+	}
+	for i := range keys {
+		if keys[i].Secret != "" {
+			a.keys[keys[i].Name] = &keys[i]
+		}
+	}
+	return a
+}
+
+type authNonce struct {
+	key   string
+	nonce string
+}
+
+// nonceCache keeps the nonces of the accepted requests until they expire.
+// It is safe for concurrent use.
+type nonceCache struct {
+	mu sync.Mutex
+	// seen maps the keys and the nonces of the accepted requests to the
+	// time they expire at
+	seen map[authNonce]time.Time
+	// prunedAt is the time the expired nonces are removed at
+	prunedAt time.Time
+}
+
+// add keeps n until expiresAt. It returns false if n is already kept.
+func (c *nonceCache) add(n authNonce, now, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the expired nonces are removed once in a while not to scan them on
+	// every request
+	if now.Sub(c.prunedAt) >= time.Second {
+		for seen, seenExpiresAt := range c.seen {
+			if now.After(seenExpiresAt) {
+				delete(c.seen, seen)
+			}
+		}
+		c.prunedAt = now
+	}
+	if _, ok := c.seen[n]; ok {
+		return false
+	}
+	c.seen[n] = expiresAt
+	return true
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*APIKey, error) {
+	name := r.Header.Get(AuthKeyHeader)
+	if name == "" {
+		return nil, nil
+	}
+	key, ok := a.keys[name]
+	if !ok {
+		return nil, &AuthError{Reason: "unknown key"}
+	}
+
+	timestamp := r.Header.Get(AuthTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, &AuthError{Key: name, Reason: "invalid timestamp"}
+	}
+	now := a.now()
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-a.maxClockSkew)) || signedAt.After(now.Add(a.maxClockSkew)) {
+		return nil, &AuthError{Key: name, Reason: "timestamp out of range"}
+	}
+
+	nonce := r.Header.Get(AuthNonceHeader)
+	if !isRequestIDValid(nonce) {
+		return nil, &AuthError{Key: name, Reason: "invalid nonce"}
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(AuthSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return nil, &AuthError{Key: name, Reason: "invalid signature"}
+	}
+	// the names of the keys are not secret, so the body is limited before
+	// the signature is verified
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, a.maxBodySize+1))
+	if err != nil {
+		return nil, &AuthError{Key: name, Reason: "body could not be read"}
+	}
+	if int64(len(body)) > a.maxBodySize {
+		return nil, &AuthError{Key: name, Reason: authReasonBodyTooLarge}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(signature, SignRequest(key.Secret, timestamp, nonce, r.Method, r.URL.RequestURI(), body)) {
+		return nil, &AuthError{Key: name, Reason: "invalid signature"}
+	}
+
+	if !a.nonces.add(authNonce{key: name, nonce: nonce}, now, signedAt.Add(a.maxClockSkew)) {
+		return nil, &AuthError{Key: name, Reason: "replayed request"}
+	}
+	return key, nil
+}
+
+// SignRequest returns the signature of the request for HMACAuthenticator.
+func SignRequest(secret, timestamp, nonce, method, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", timestamp, nonce, method, requestURI)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// authenticators holds []Authenticator, which is empty if the
+// authentication is disabled.
+var authenticators atomic.Value
+
+// SetAuthenticators replaces the authenticators of the API. The requests
+// are tried with them in order. No authenticator disables the
+// authentication.
+func SetAuthenticators(auths ...Authenticator) {
+	authenticators.Store(auths)
+}
+
+func currentAuthenticators() []Authenticator {
+	auths, _ := authenticators.Load().([]Authenticator)
+	return auths
+}
+
+// InitAuth sets up the authenticators with the API keys in auth.keys_file.
+// The authentication is disabled if it is not set.
+func InitAuth(conf SectionAuth) error {
+	if conf.KeysFile == "" {
+		SetAuthenticators()
+		return nil
+	}
+	keys, err := LoadAPIKeys(conf.KeysFile)
+	if err != nil {
+		return err
+	}
+	hmacAuth := NewHMACAuthenticator(keys, time.Duration(conf.MaxClockSkew)*time.Second, conf.MaxBodySize*1024*1024)
+	// the nonces are kept across the reloads, or the requests signed just
+	// before them could be replayed
+	for _, auth := range currentAuthenticators() {
+		if prev, ok := auth.(*HMACAuthenticator); ok {
+			hmacAuth.nonces = prev.nonces
+		}
+	}
+	SetAuthenticators(NewBearerAuthenticator(keys), hmacAuth)
+	return nil
+}
+
+func authenticate(r *http.Request, auths []Authenticator) (*APIKey, error) {
+	for _, auth := range auths {
+		key, err := auth.Authenticate(r)
+		if err != nil || key != nil {
+			return key, err
+		}
+	}
+	return nil, &AuthError{Reason: "no credentials"}
+}
+
+// withAuth allows only the requests with the key of scope to h, if the
+// authentication is enabled. The principal of the request is the name of
+// the key. It must be wrapped by withAccessLog.
+func withAuth(scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths := currentAuthenticators()
+		if len(auths) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := authenticate(r, auths)
+		if err != nil {
+			authErr, ok := err.(*AuthError)
+			if !ok {
+				authErr = &AuthError{Reason: err.Error()}
+			}
+			LogAuthFailure(r, authErr.Key, authErr.Reason)
+			countAuthFailure(authErr.Key, authErr.Reason)
+			if authErr.Reason == authReasonBodyTooLarge {
+				sendResponse(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gaurun"`)
+			sendResponse(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !key.HasScope(scope) {
+			reason := fmt.Sprintf("no scope %s", scope)
+			LogAuthFailure(r, key.Name, reason)
+			countAuthFailure(key.Name, reason)
+			sendResponse(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.principal = key.Name
+		}
+		countAPIKeyRequest(key.Name)
+		h.ServeHTTP(w, r)
+	})
+}
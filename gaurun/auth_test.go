@@ -0,0 +1,262 @@
+package gaurun
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAPIKeys(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "api_keys.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+const testAPIKeys = `
+[[keys]]
+name = "pusher"
+token = "pusher-token"
+scopes = ["push"]
+
+[[keys]]
+name = "operator"
+token = "operator-token"
+secret = "operator-secret"
+scopes = ["stat", "admin"]
+`
+
+func TestLoadAPIKeys(t *testing.T) {
+	keys, err := LoadAPIKeys(writeAPIKeys(t, testAPIKeys))
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "pusher", keys[0].Name)
+	assert.True(t, keys[1].HasScope(AuthScopeAdmin))
+	assert.False(t, keys[1].HasScope(AuthScopePush))
+
+	cases := []struct {
+		Name    string
+		Content string
+	}{
+		{"no key", ``},
+		{"no name", `[[keys]]
+token = "a"
+scopes = ["push"]`},
+		{"duplicated name", `[[keys]]
+name = "a"
+token = "a"
+scopes = ["push"]
+[[keys]]
+name = "a"
+token = "b"
+scopes = ["push"]`},
+		{"duplicated token", `[[keys]]
+name = "a"
+token = "a"
+scopes = ["push"]
+[[keys]]
+name = "b"
+token = "a"
+scopes = ["push"]`},
+		{"no credential", `[[keys]]
+name = "a"
+scopes = ["push"]`},
+		{"no scope", `[[keys]]
+name = "a"
+token = "a"`},
+		{"unknown scope", `[[keys]]
+name = "a"
+token = "a"
+scopes = ["root"]`},
+	}
+	for _, c := range cases {
+		_, err := LoadAPIKeys(writeAPIKeys(t, c.Content))
+		assert.Error(t, err, c.Name)
+	}
+}
+
+func signedRequest(method, target, body, key, secret string, at time.Time) *http.Request {
+	return signedRequestWithNonce(method, target, body, key, secret, at, newRequestID())
+}
+
+func signedRequestWithNonce(method, target, body, key, secret string, at time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(AuthKeyHeader, key)
+	r.Header.Set(AuthTimestampHeader, timestamp)
+	r.Header.Set(AuthNonceHeader, nonce)
+	r.Header.Set(AuthSignatureHeader, hex.EncodeToString(SignRequest(secret, timestamp, nonce, method, r.URL.RequestURI(), []byte(body))))
+	return r
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	keys, err := LoadAPIKeys(writeAPIKeys(t, testAPIKeys))
+	require.NoError(t, err)
+	auth := NewHMACAuthenticator(keys, 5*time.Minute, 64)
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	key, err := auth.Authenticate(httptest.NewRequest("GET", "/stat/app", nil))
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	r := signedRequestWithNonce("POST", "/push?a=b", `{"notifications":[]}`, "operator", "operator-secret", now, "nonce-1")
+	key, err = auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "operator", key.Name)
+	// the body is left for the handler
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"notifications":[]}`, string(body))
+
+	// the same request is not accepted again
+	_, err = auth.Authenticate(signedRequestWithNonce("POST", "/push?a=b", `{"notifications":[]}`, "operator", "operator-secret", now, "nonce-1"))
+	assert.EqualError(t, err, `replayed request (key "operator")`)
+	// but the identical one with another nonce is, even in the same second
+	_, err = auth.Authenticate(signedRequestWithNonce("POST", "/push?a=b", `{"notifications":[]}`, "operator", "operator-secret", now, "nonce-2"))
+	assert.NoError(t, err)
+
+	failures := []struct {
+		Reason  string
+		Request *http.Request
+	}{
+		{"unknown key", signedRequest("GET", "/stat/app", "", "pusher", "pusher-token", now)},
+		{"timestamp out of range", signedRequest("GET", "/stat/app", "", "operator", "operator-secret", now.Add(-6*time.Minute))},
+		{"timestamp out of range", signedRequest("GET", "/stat/app", "", "operator", "operator-secret", now.Add(6*time.Minute))},
+		{"invalid signature", signedRequest("GET", "/stat/app", "", "operator", "wrong-secret", now)},
+		{"invalid nonce", signedRequestWithNonce("GET", "/stat/app", "", "operator", "operator-secret", now, "")},
+		{authReasonBodyTooLarge, signedRequest("POST", "/push", strings.Repeat("a", 65), "operator", "operator-secret", now)},
+	}
+	for _, f := range failures {
+		_, err := auth.Authenticate(f.Request)
+		require.Error(t, err, f.Reason)
+		assert.Equal(t, f.Reason, err.(*AuthError).Reason)
+	}
+	// only the names of the loaded keys are told
+	_, err = auth.Authenticate(signedRequest("GET", "/stat/app", "", "intruder", "secret", now))
+	assert.Equal(t, &AuthError{Reason: "unknown key"}, err)
+
+	// the tampered request
+	r = signedRequest("PUT", "/config/pushers?max=1", "", "operator", "operator-secret", now.Add(time.Second))
+	r.URL.RawQuery = "max=100"
+	_, err = auth.Authenticate(r)
+	assert.EqualError(t, err, `invalid signature (key "operator")`)
+
+	// the nonces seen are forgotten after they expire
+	now = now.Add(10 * time.Minute)
+	_, err = auth.Authenticate(signedRequest("GET", "/stat/app", "", "operator", "operator-secret", now))
+	assert.NoError(t, err)
+	assert.Len(t, auth.nonces.seen, 1)
+}
+
+func TestInitAuthKeepsNonces(t *testing.T) {
+	defer SetAuthenticators()
+
+	conf := BuildDefaultConf().Auth
+	conf.KeysFile = writeAPIKeys(t, testAPIKeys)
+	require.NoError(t, InitAuth(conf))
+
+	now := time.Now()
+	request := func() *http.Request {
+		return signedRequestWithNonce("GET", "/stat/app", "", "operator", "operator-secret", now, "nonce-1")
+	}
+	_, err := authenticate(request(), currentAuthenticators())
+	require.NoError(t, err)
+
+	// the request is not replayed after the reload on SIGHUP
+	require.NoError(t, InitAuth(conf))
+	_, err = authenticate(request(), currentAuthenticators())
+	assert.EqualError(t, err, `replayed request (key "operator")`)
+}
+
+func TestWithAuth(t *testing.T) {
+	confBefore := ConfGaurun
+	accessBefore := LogAccess
+	auditBefore := LogAudit
+	defer func() {
+		ConfGaurun = confBefore
+		LogAccess = accessBefore
+		LogAudit = auditBefore
+		SetAuthenticators()
+		resetStat()
+	}()
+	ConfGaurun = BuildDefaultConf()
+	resetStat()
+
+	dir := t.TempDir()
+	var err error
+	LogAccess, _, err = InitLog(filepath.Join(dir, "access.log"), "info")
+	require.NoError(t, err)
+	LogAudit, _, err = InitLog(filepath.Join(dir, "audit.log"), "info")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(mux)
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	withToken := func(r *http.Request, token string) *http.Request {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	// the authentication is disabled without the keys
+	require.NoError(t, InitAuth(ConfGaurun.Auth))
+	assert.Equal(t, http.StatusOK, serve(httptest.NewRequest("GET", "/stat/app", nil)))
+
+	ConfGaurun.Auth.KeysFile = writeAPIKeys(t, testAPIKeys)
+	require.NoError(t, InitAuth(ConfGaurun.Auth))
+
+	assert.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/stat/app", nil)))
+	assert.Equal(t, http.StatusUnauthorized, serve(withToken(httptest.NewRequest("GET", "/stat/app", nil), "wrong-token")))
+	assert.Equal(t, http.StatusForbidden, serve(withToken(httptest.NewRequest("GET", "/stat/app", nil), "pusher-token")))
+	assert.Equal(t, http.StatusOK, serve(withToken(httptest.NewRequest("GET", "/stat/app", nil), "operator-token")))
+	assert.Equal(t, http.StatusOK, serve(signedRequest("PUT", "/config/pushers?max=3", "", "operator", "operator-secret", time.Now())))
+	// the names of unknown keys are not counted
+	assert.Equal(t, http.StatusUnauthorized, serve(signedRequest("GET", "/stat/app", "", "intruder", "secret", time.Now())))
+	// the probes are not authenticated
+	assert.Equal(t, http.StatusOK, serve(httptest.NewRequest("GET", "/healthz", nil)))
+
+	stat := getStatAppWithToken(t, mux, "operator-token")
+	assert.Equal(t, map[string]StatAPIKey{
+		"pusher":   {Requests: 0, AuthFailures: 1},
+		"operator": {Requests: 3, AuthFailures: 0},
+	}, stat.APIKeys)
+
+	require.NoError(t, LogAccess.Sync())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(b), `"type":"auth-failure"`))
+	assert.NotContains(t, string(b), "intruder")
+	assert.Contains(t, string(b), `"reason":"no credentials"`)
+	assert.Contains(t, string(b), `"reason":"invalid token"`)
+	assert.Contains(t, string(b), `"key":"pusher","reason":"no scope stat"`)
+
+	require.NoError(t, LogAudit.Sync())
+	b, err = ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"principal":"operator"`)
+}
+
+// getStatAppWithToken gets /stat/app with the bearer token.
+func getStatAppWithToken(t *testing.T, mux *http.ServeMux, token string) StatApp {
+	r := httptest.NewRequest("GET", "/stat/app", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stat StatApp
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stat))
+	return stat
+}
@@ -0,0 +1,367 @@
+package gaurun
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"go.uber.org/zap/zapcore"
+)
+
+// oidUserID is the subject attribute in which Apple stores the bundle ID
+// (= apns-topic) of a push certificate.
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// UnknownConfKey is a key in the configuration file which does not
+// correspond to any field of ConfToml.
+type UnknownConfKey struct {
+	Key        string
+	Line       int
+	Suggestion string
+}
+
+func (k UnknownConfKey) String() string {
+	s := fmt.Sprintf("unknown key %q (line %d)", k.Key, k.Line)
+	if k.Suggestion != "" {
+		s += fmt.Sprintf(", did you mean %q?", k.Suggestion)
+	}
+	return s
+}
+
+// FindUnknownConfKeys returns the keys in the configuration file which
+// LoadConf silently ignores.
+func FindUnknownConfKeys(confPath string) ([]UnknownConfKey, error) {
+	tree, err := toml.LoadFile(confPath)
+	if err != nil {
+		return nil, err
+	}
+	unknownKeys := findUnknownConfKeys(tree, reflect.TypeOf(ConfToml{}), "")
+	sort.Slice(unknownKeys, func(i, j int) bool {
+		return unknownKeys[i].Line < unknownKeys[j].Line
+	})
+	return unknownKeys, nil
+}
+
+func findUnknownConfKeys(tree *toml.Tree, t reflect.Type, prefix string) []UnknownConfKey {
+	known := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("toml"); name != "" {
+			known[name] = t.Field(i).Type
+		}
+	}
+
+	var unknownKeys []UnknownConfKey
+	for _, key := range tree.Keys() {
+		fieldType, ok := known[key]
+		if !ok {
+			unknownKeys = append(unknownKeys, UnknownConfKey{
+				Key:        prefix + key,
+				Line:       tree.GetPositionPath([]string{key}).Line,
+				Suggestion: suggestConfKey(key, known, prefix),
+			})
+			continue
+		}
+		if subtree, ok := tree.GetPath([]string{key}).(*toml.Tree); ok && fieldType.Kind() == reflect.Struct {
+			unknownKeys = append(unknownKeys, findUnknownConfKeys(subtree, fieldType, prefix+key+".")...)
+		}
+	}
+	return unknownKeys
+}
+
+// suggestConfKey returns the known key closest to key, if any is close
+// enough to be a plausible misspelling.
+func suggestConfKey(key string, known map[string]reflect.Type, prefix string) string {
+	const maxDistance = 2
+	suggestion := ""
+	best := maxDistance + 1
+	for name := range known {
+		if d := editDistance(key, name); d < best || (d == best && name < suggestion) {
+			best = d
+			suggestion = name
+		}
+	}
+	if suggestion == "" {
+		return ""
+	}
+	return prefix + suggestion
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ValidateConf checks the ranges of configuration values and returns
+// every violation it finds.
+func ValidateConf(conf ConfToml) []error {
+	var errs []error
+	positive := func(name string, v int64) {
+		if v <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be greater than 0 (got %d)", name, v))
+		}
+	}
+	notNegative := func(name string, v int64) {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative (got %d)", name, v))
+		}
+	}
+	atMost := func(name string, v, max int64) {
+		if v > max {
+			errs = append(errs, fmt.Errorf("%s must be less than or equal to %d (got %d)", name, max, v))
+		}
+	}
+
+	positive("core.workers", conf.Core.WorkerNum)
+	atMost("core.workers", conf.Core.WorkerNum, MaxWorkerNum)
+	positive("core.queues", conf.Core.QueueNum)
+	atMost("core.queues", conf.Core.QueueNum, MaxQueueNum)
+	positive("core.notification_max", conf.Core.NotificationMax)
+	notNegative("core.pusher_max", conf.Core.PusherMax)
+	notNegative("core.shutdown_timeout", conf.Core.ShutdownTimeout)
+	notNegative("core.shutdown_delay", conf.Core.ShutdownDelay)
+	positive("core.pause_hold_max", conf.Core.PauseHoldMax)
+	if conf.Core.QueueSaturationRatio <= 0 || conf.Core.QueueSaturationRatio > 1 {
+		errs = append(errs, fmt.Errorf("core.queue_saturation_ratio must be greater than 0 and less than or equal to 1 (got %v)", conf.Core.QueueSaturationRatio))
+	}
+
+	positive("android.timeout", int64(conf.Android.Timeout))
+	notNegative("android.keepalive_timeout", int64(conf.Android.KeepAliveTimeout))
+	notNegative("android.keepalive_conns", int64(conf.Android.KeepAliveConns))
+	notNegative("android.retry_max", int64(conf.Android.RetryMax))
+
+	positive("ios.timeout", int64(conf.Ios.Timeout))
+	notNegative("ios.keepalive_timeout", int64(conf.Ios.KeepAliveTimeout))
+	notNegative("ios.keepalive_conns", int64(conf.Ios.KeepAliveConns))
+	notNegative("ios.retry_max", int64(conf.Ios.RetryMax))
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(conf.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level must be one of debug, info, warn, error, dpanic, panic or fatal (got %q)", conf.Log.Level))
+	}
+	switch conf.Log.TokenMask {
+	case LogTokenMaskNone, LogTokenMaskTruncate:
+	case LogTokenMaskHash:
+		if conf.Log.TokenHashKey == "" {
+			errs = append(errs, fmt.Errorf("log.token_hash_key must be set when log.token_mask is %s", LogTokenMaskHash))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("log.token_mask must be one of %s, %s or %s (got %q)", LogTokenMaskNone, LogTokenMaskHash, LogTokenMaskTruncate, conf.Log.TokenMask))
+	}
+	switch conf.Log.Content {
+	case LogContentFull, LogContentRedact, LogContentOmit:
+	default:
+		errs = append(errs, fmt.Errorf("log.content must be one of %s, %s or %s (got %q)", LogContentFull, LogContentRedact, LogContentOmit, conf.Log.Content))
+	}
+	switch conf.Log.Format {
+	case LogFormatJSON, LogFormatConsole, LogFormatLTSV:
+	default:
+		errs = append(errs, fmt.Errorf("log.format must be one of %s, %s or %s (got %q)", LogFormatJSON, LogFormatConsole, LogFormatLTSV, conf.Log.Format))
+	}
+	notNegative("log.rotate_size", conf.Log.RotateSize)
+	switch conf.Log.RotateInterval {
+	case "", LogRotateHourly, LogRotateDaily:
+	default:
+		errs = append(errs, fmt.Errorf("log.rotate_interval must be %s or %s (got %q)", LogRotateHourly, LogRotateDaily, conf.Log.RotateInterval))
+	}
+	notNegative("log.rotate_backups", int64(conf.Log.RotateBackups))
+	notNegative("log.rotate_max_age", int64(conf.Log.RotateMaxAge))
+	for _, out := range []string{conf.Log.AccessLog, conf.Log.ErrorLog, conf.Log.AuditLog} {
+		if isSyslogOutput(out) {
+			if err := checkSyslogSupported(); err != nil {
+				errs = append(errs, err)
+			} else if _, _, err := parseSyslogOutput(out); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	switch conf.Trace.Exporter {
+	case TraceExporterNone, TraceExporterStdout, TraceExporterOTLPHTTP:
+	default:
+		errs = append(errs, fmt.Errorf("trace.exporter must be one of %s, %s or %s (got %q)", TraceExporterNone, TraceExporterStdout, TraceExporterOTLPHTTP, conf.Trace.Exporter))
+	}
+	if conf.Trace.SampleRatio < 0 || conf.Trace.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("trace.sample_ratio must be between 0 and 1 (got %v)", conf.Trace.SampleRatio))
+	}
+
+	positive("auth.max_clock_skew", conf.Auth.MaxClockSkew)
+	positive("auth.max_body_size", conf.Auth.MaxBodySize)
+
+	return errs
+}
+
+// ValidateProviders checks that at least one platform is enabled and that
+// the credentials of the enabled platforms can be loaded.
+func ValidateProviders(conf ConfToml) error {
+	if !conf.Ios.Enabled && !conf.Android.Enabled {
+		return fmt.Errorf("no platform has been enabled")
+	}
+
+	if conf.Ios.Enabled {
+		if _, err := LoadApnsCredentialInfo(&conf.Ios); err != nil {
+			return err
+		}
+	}
+
+	if conf.Android.Enabled {
+		if conf.Android.ApiKey == "" {
+			return fmt.Errorf("the APIKey for Android cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// ApnsCredentialInfo describes the credential used to connect to APNs.
+type ApnsCredentialInfo struct {
+	// Certificate is set only for certificate-based provider connection trust
+	Certificate *x509.Certificate
+	// KeyID and TeamID are set only for token-based provider connection trust
+	KeyID  string
+	TeamID string
+}
+
+// Topic returns the bundle ID the certificate was issued for.
+func (info *ApnsCredentialInfo) Topic() string {
+	if info.Certificate == nil {
+		return ""
+	}
+	for _, name := range info.Certificate.Subject.Names {
+		if name.Type.Equal(oidUserID) {
+			if topic, ok := name.Value.(string); ok {
+				return topic
+			}
+		}
+	}
+	return ""
+}
+
+// LoadApnsCredentialInfo loads the APNs credential configured in s.
+func LoadApnsCredentialInfo(s *SectionIos) (*ApnsCredentialInfo, error) {
+	if s.IsCertificateBasedProvider() && s.IsTokenBasedProvider() {
+		return nil, fmt.Errorf("you can use only one of certificate-based provider or token-based provider connection trust")
+	}
+
+	if s.IsCertificateBasedProvider() {
+		cert, err := LoadApnsCertificate(s)
+		if err != nil {
+			return nil, fmt.Errorf("the certification or key for iOS was not loading: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("the certification file for iOS was not parsed: %v", err)
+		}
+		return &ApnsCredentialInfo{Certificate: leaf}, nil
+	}
+
+	if s.IsTokenBasedProvider() {
+		if _, err := LoadApnsAuthKey(s); err != nil {
+			return nil, fmt.Errorf("the auth key for iOS was not loading: %v", err)
+		}
+		return &ApnsCredentialInfo{KeyID: s.TokenAuthKeyID, TeamID: s.TokenAuthTeamID}, nil
+	}
+
+	return nil, fmt.Errorf("the key file or APNsAuthKey file for iOS was not found")
+}
+
+// CheckConf validates conf, which was loaded from confPath, and writes
+// a human readable report to w. It returns false if any problem is found.
+func CheckConf(w io.Writer, conf ConfToml, confPath string) bool {
+	var errs []error
+
+	if confPath != "" {
+		unknownKeys, err := FindUnknownConfKeys(confPath)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, k := range unknownKeys {
+			errs = append(errs, fmt.Errorf("%s", k))
+		}
+	}
+
+	errs = append(errs, ValidateConf(conf)...)
+
+	if !conf.Ios.Enabled && !conf.Android.Enabled {
+		errs = append(errs, fmt.Errorf("no platform has been enabled"))
+	}
+
+	if conf.Ios.Enabled {
+		info, err := LoadApnsCredentialInfo(&conf.Ios)
+		if err != nil {
+			errs = append(errs, err)
+		} else if info.Certificate != nil {
+			notAfter := info.Certificate.NotAfter
+			fmt.Fprintf(w, "ios: certificate-based provider, topic %q, expires at %s\n", info.Topic(), notAfter.UTC().Format(time.RFC3339))
+			if time.Now().After(notAfter) {
+				errs = append(errs, fmt.Errorf("the certification for iOS expired at %s", notAfter.UTC().Format(time.RFC3339)))
+			}
+			if conf.Ios.Topic != "" && info.Topic() != "" && conf.Ios.Topic != info.Topic() {
+				fmt.Fprintf(w, "ios: ios.topic %q differs from the certificate topic %q\n", conf.Ios.Topic, info.Topic())
+			}
+		} else {
+			fmt.Fprintf(w, "ios: token-based provider, key id %q, team id %q\n", info.KeyID, info.TeamID)
+		}
+	}
+
+	if conf.Android.Enabled && conf.Android.ApiKey == "" {
+		errs = append(errs, fmt.Errorf("the APIKey for Android cannot be empty"))
+	}
+
+	if conf.Log.Format == LogFormatConsole {
+		fmt.Fprintf(w, "log: gaurun_recover cannot read the access log and the payload log in log.format %q\n", LogFormatConsole)
+	}
+
+	if conf.Auth.KeysFile != "" {
+		keys, err := LoadAPIKeys(conf.Auth.KeysFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			fmt.Fprintf(w, "auth: %d API keys\n", len(keys))
+		}
+	} else {
+		fmt.Fprintf(w, "auth: disabled\n")
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+
+	if confPath == "" {
+		confPath = "(environment variables)"
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "configuration %s test failed\n", confPath)
+		return false
+	}
+
+	fmt.Fprintf(w, "configuration %s test is successful\n", confPath)
+	return true
+}
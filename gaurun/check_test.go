@@ -0,0 +1,165 @@
+package gaurun
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed APNs-like certificate and its
+// key into dir and returns their paths.
+func writeTestCertificate(t *testing.T, dir, topic string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Apple Push Services: " + topic,
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: topic}},
+		},
+		NotBefore: notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:  notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+func writeTestConf(t *testing.T, dir, doc string) string {
+	confPath := filepath.Join(dir, "gaurun.toml")
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(doc), 0600))
+	return confPath
+}
+
+func TestFindUnknownConfKeys(t *testing.T) {
+	confPath := writeTestConf(t, t.TempDir(), `
+[core]
+port = "1056"
+worker = 8
+
+[ios]
+pem_cert_pth = "cert.pem"
+
+[unknown]
+foo = 1
+`)
+
+	unknownKeys, err := FindUnknownConfKeys(confPath)
+	require.NoError(t, err)
+	assert.Equal(t, []UnknownConfKey{
+		{Key: "core.worker", Line: 4, Suggestion: "core.workers"},
+		{Key: "ios.pem_cert_pth", Line: 7, Suggestion: "ios.pem_cert_path"},
+		{Key: "unknown", Line: 9, Suggestion: ""},
+	}, unknownKeys)
+
+	unknownKeys, err = FindUnknownConfKeys(ConfGaurunPath)
+	require.NoError(t, err)
+	assert.Empty(t, unknownKeys)
+}
+
+func TestValidateConf(t *testing.T) {
+	conf := BuildDefaultConf()
+	assert.Empty(t, ValidateConf(conf))
+
+	conf.Core.WorkerNum = 0
+	conf.Core.QueueNum = MaxQueueNum + 1
+	conf.Ios.Timeout = 0
+	conf.Log.Level = "verbose"
+	conf.Log.TokenMask = LogTokenMaskHash
+	conf.Log.Content = "none"
+	conf.Log.Format = "xml"
+	conf.Log.RotateInterval = "weekly"
+	conf.Log.ErrorLog = "syslog:http:localhost"
+	errs := ValidateConf(conf)
+	require.Len(t, errs, 9)
+	assert.EqualError(t, errs[0], "core.workers must be greater than 0 (got 0)")
+	assert.EqualError(t, errs[1], "core.queues must be less than or equal to 1048576 (got 1048577)")
+	assert.EqualError(t, errs[2], "ios.timeout must be greater than 0 (got 0)")
+	assert.Contains(t, errs[3].Error(), "log.level")
+	assert.EqualError(t, errs[4], "log.token_hash_key must be set when log.token_mask is hash")
+	assert.Contains(t, errs[5].Error(), "log.content")
+	assert.Contains(t, errs[6].Error(), "log.format")
+	assert.Contains(t, errs[7].Error(), "log.rotate_interval")
+	assert.Contains(t, errs[8].Error(), "syslog")
+}
+
+func TestLoadApnsCredentialInfo(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	certPath, keyPath := writeTestCertificate(t, dir, "com.example.app", notAfter)
+
+	info, err := LoadApnsCredentialInfo(&SectionIos{PemCertPath: certPath, PemKeyPath: keyPath})
+	require.NoError(t, err)
+	assert.Equal(t, "com.example.app", info.Topic())
+	assert.True(t, info.Certificate.NotAfter.Equal(notAfter))
+
+	info, err = LoadApnsCredentialInfo(&SectionIos{
+		TokenAuthKeyPath: "../buford/token/testdata/authkey-valid.p8",
+		TokenAuthKeyID:   "key-id",
+		TokenAuthTeamID:  "team-id",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "key-id", info.KeyID)
+	assert.Equal(t, "", info.Topic())
+
+	_, err = LoadApnsCredentialInfo(&SectionIos{PemCertPath: certPath, PemKeyPath: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err)
+
+	_, err = LoadApnsCredentialInfo(&SectionIos{})
+	assert.Error(t, err)
+}
+
+func TestCheckConf(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCertificate(t, dir, "com.example.app", time.Now().Add(24*time.Hour))
+	confPath := writeTestConf(t, dir, `
+[android]
+apikey = "apikey"
+
+[ios]
+pem_cert_path = "`+certPath+`"
+pem_key_path = "`+keyPath+`"
+`)
+	conf, err := LoadConf(BuildDefaultConf(), confPath)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.True(t, CheckConf(&out, conf, confPath))
+	assert.Contains(t, out.String(), `topic "com.example.app"`)
+	assert.NotContains(t, out.String(), "gaurun_recover")
+	assert.Contains(t, out.String(), "test is successful")
+
+	// the console format is allowed but warned
+	out.Reset()
+	conf.Log.Format = LogFormatConsole
+	assert.True(t, CheckConf(&out, conf, confPath))
+	assert.Contains(t, out.String(), `log: gaurun_recover cannot read the access log and the payload log in log.format "console"`)
+
+	out.Reset()
+	conf.Android.ApiKey = ""
+	conf.Core.WorkerNum = 0
+	assert.False(t, CheckConf(&out, conf, confPath))
+	assert.Contains(t, out.String(), "error: core.workers must be greater than 0 (got 0)")
+	assert.Contains(t, out.String(), "error: the APIKey for Android cannot be empty")
+	assert.Contains(t, out.String(), "test failed")
+}
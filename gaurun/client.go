@@ -2,12 +2,12 @@ package gaurun
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"time"
 
-	"github.com/mercari/gaurun/buford/token"
 	"github.com/mercari/gaurun/gcm"
 )
 
@@ -30,7 +30,7 @@ func keepAliveInterval(keepAliveTimeout int) int {
 // InitGCMClient initializes GCMClient which is globally declared.
 func InitGCMClient() error {
 	var err error
-	GCMClient, err = gcm.NewClient(gcm.FCMSendEndpoint, ConfGaurun.Android.ApiKey)
+	GCMClient, err = gcm.NewClient(ConfGaurun.Android.Endpoint, ConfGaurun.Android.ApiKey)
 	if err != nil {
 		return err
 	}
@@ -55,14 +55,15 @@ func InitGCMClient() error {
 func InitAPNSClient() error {
 	var err error
 	if ConfGaurun.Ios.IsCertificateBasedProvider() {
-		APNSClient, err = NewApnsClientHttp2(
-			ConfGaurun.Ios.PemCertPath,
-			ConfGaurun.Ios.PemKeyPath,
-			ConfGaurun.Ios.PemKeyPassphrase,
-		)
+		var cert tls.Certificate
+		cert, err = LoadApnsCertificate(&ConfGaurun.Ios)
+		if err != nil {
+			return err
+		}
+		APNSClient, err = NewApnsClientHttp2ForCertificate(cert)
 	} else if ConfGaurun.Ios.IsTokenBasedProvider() {
 		var authKey *ecdsa.PrivateKey
-		authKey, err = token.AuthKeyFromFile(ConfGaurun.Ios.TokenAuthKeyPath)
+		authKey, err = LoadApnsAuthKey(&ConfGaurun.Ios)
 		if err != nil {
 			return err
 		}
@@ -77,5 +78,6 @@ func InitAPNSClient() error {
 	if err != nil {
 		return err
 	}
+	observeCertificateExpiry(APNSClient)
 	return nil
 }
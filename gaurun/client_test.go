@@ -1,9 +1,20 @@
 package gaurun
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/mercari/gaurun/apnstest"
+	"github.com/mercari/gaurun/fcmtest"
+	"github.com/mercari/gaurun/gcm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeepAliveInterval(t *testing.T) {
@@ -14,3 +25,180 @@ func TestKeepAliveInterval(t *testing.T) {
 	assert.Equal(t, 90, keepAliveInterval(300))
 	assert.Equal(t, 90, keepAliveInterval(600))
 }
+
+func writeServerCertificate(t *testing.T, cert *x509.Certificate) string {
+	path := filepath.Join(t.TempDir(), "root-ca.pem")
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	require.NoError(t, err)
+	return path
+}
+
+// captureAccessLog makes LogAccess write to a file and returns the function
+// to read the logs of push notifications in it.
+func captureAccessLog(t *testing.T) func() []LogPushEntry {
+	accessBefore := LogAccess
+	t.Cleanup(func() {
+		LogAccess = accessBefore
+	})
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	var err error
+	LogAccess, _, err = InitLog(path, "info")
+	require.NoError(t, err)
+
+	return func() []LogPushEntry {
+		require.NoError(t, LogAccess.Sync())
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		var entries []LogPushEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var entry LogPushEntry
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+}
+
+func TestPushNotificationIosWithFakeAPNs(t *testing.T) {
+	s := apnstest.NewServer()
+	defer s.Close()
+
+	defer func(conf ConfToml, client APNsClient) {
+		ConfGaurun = conf
+		APNSClient = client
+	}(ConfGaurun, APNSClient)
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Ios.TokenAuthKeyPath = "testdata/authkey.p8"
+	ConfGaurun.Ios.TokenAuthKeyID = "key-id"
+	ConfGaurun.Ios.TokenAuthTeamID = "team-id"
+	ConfGaurun.Ios.Topic = "com.example.gaurun"
+	ConfGaurun.Ios.Endpoint = s.URL
+	ConfGaurun.Ios.RootCAPath = writeServerCertificate(t, s.Certificate())
+	require.NoError(t, InitAPNSClient())
+	s.AuthKey = &APNSClient.Token.AuthKey.PublicKey
+
+	readAccessLog := captureAccessLog(t)
+	token := strings.Repeat("1", 64)
+	apnsID := "123e4567-e89b-12d3-a456-426655440000"
+	req := RequestGaurunNotification{Tokens: []string{token}, Platform: PlatFormIos, Message: "hello", ApnsID: apnsID}
+	require.NoError(t, pushNotificationIos(req))
+
+	pushes := s.Pushes()
+	require.Len(t, pushes, 1)
+	assert.Equal(t, apnsID, pushes[0].ID)
+	entries := readAccessLog()
+	require.Len(t, entries, 1)
+	assert.Equal(t, StatusSucceededPush, entries[0].Type)
+	assert.Equal(t, apnsID, entries[0].ApnsID)
+	assert.Equal(t, apnsID, entries[0].MessageID)
+	assert.Equal(t, token, pushes[0].DeviceToken)
+	assert.Equal(t, "com.example.gaurun", pushes[0].Header.Get("apns-topic"))
+	assert.JSONEq(t, `{"aps":{"alert":"hello","badge":0}}`, string(pushes[0].Payload))
+
+	service := NewApnsServiceHttp2(APNSClient)
+	headers := NewApnsHeadersHttp2WithToken(&RequestGaurunNotification{}, APNSClient.Token)
+	id, err := ApnsPushHttp2WithID(token, service, headers, NewApnsPayloadHttp2(&req))
+	require.NoError(t, err)
+	assert.True(t, isApnsID(id))
+	require.NoError(t, ApnsPushHttp2(token, service, headers, NewApnsPayloadHttp2(&req)))
+	assert.Len(t, s.Pushes(), 3)
+
+	s.FailToken(token, apnstest.Failure{Status: http.StatusGone, Reason: "Unregistered"})
+	err = pushNotificationIos(req)
+	require.Error(t, err)
+	assert.Equal(t, "Unregistered", pushErrorReason(err))
+}
+
+func TestPushNotificationAndroidWithFakeFCM(t *testing.T) {
+	s := fcmtest.NewServer()
+	defer s.Close()
+	s.APIKey = "apikey"
+
+	defer func(conf ConfToml, client *gcm.Client) {
+		ConfGaurun = conf
+		GCMClient = client
+	}(ConfGaurun, GCMClient)
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Android.ApiKey = "apikey"
+	ConfGaurun.Android.Endpoint = s.URL
+	require.NoError(t, InitGCMClient())
+
+	readAccessLog := captureAccessLog(t)
+	req := RequestGaurunNotification{Tokens: []string{"token"}, Platform: PlatFormAndroid, Message: "hello"}
+	require.NoError(t, pushNotificationAndroid(req))
+	entries := readAccessLog()
+	require.Len(t, entries, 1)
+	assert.Equal(t, StatusSucceededPush, entries[0].Type)
+	assert.NotEmpty(t, entries[0].MessageID)
+
+	messages := s.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, []string{"token"}, messages[0].Message.RegistrationIDs)
+	assert.Equal(t, "hello", messages[0].Message.Data["message"])
+
+	// the error of the result is counted by reason, but is not treated as
+	// a failure of the push
+	InitStat()
+	defer InitStat()
+	s.FailToken("token", fcmtest.Failure{Error: "NotRegistered"})
+	require.NoError(t, pushNotificationAndroid(req))
+	entries = readAccessLog()
+	require.Len(t, entries, 2)
+	assert.Equal(t, StatusSucceededPush, entries[1].Type)
+	assert.Empty(t, entries[1].MessageID)
+	stat := getStatApp(t)
+	assert.Equal(t, int64(0), stat.Android.PushError)
+	assert.Equal(t, map[string]int64{"NotRegistered": 1}, stat.Android.PushErrorReasons)
+}
+
+func TestPushNotificationDryRun(t *testing.T) {
+	apns := apnstest.NewServer()
+	defer apns.Close()
+	fcm := fcmtest.NewServer()
+	defer fcm.Close()
+
+	defer func(conf ConfToml, apnsClient APNsClient, gcmClient *gcm.Client) {
+		ConfGaurun = conf
+		APNSClient = apnsClient
+		GCMClient = gcmClient
+	}(ConfGaurun, APNSClient, GCMClient)
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Ios.TokenAuthKeyPath = "testdata/authkey.p8"
+	ConfGaurun.Ios.TokenAuthKeyID = "key-id"
+	ConfGaurun.Ios.TokenAuthTeamID = "team-id"
+	ConfGaurun.Ios.Endpoint = apns.URL
+	ConfGaurun.Ios.RootCAPath = writeServerCertificate(t, apns.Certificate())
+	ConfGaurun.Android.ApiKey = "apikey"
+	ConfGaurun.Android.Endpoint = fcm.URL
+	require.NoError(t, InitAPNSClient())
+	require.NoError(t, InitGCMClient())
+
+	token := strings.Repeat("1", 64)
+	req := RequestGaurunNotification{Tokens: []string{token}, Platform: PlatFormIos, Message: "hello", DryRun: true}
+	assert.NoError(t, pushNotificationIos(req))
+	assert.Empty(t, apns.Pushes())
+
+	req.Tokens = []string{"invalid"}
+	err := pushNotificationIos(req)
+	require.Error(t, err)
+	assert.Equal(t, "BadDeviceToken", pushErrorReason(err))
+
+	req = RequestGaurunNotification{Tokens: []string{token}, Platform: PlatFormIos, Message: strings.Repeat("a", 4096), DryRun: true}
+	err = pushNotificationIos(req)
+	require.Error(t, err)
+	assert.Equal(t, "PayloadTooLarge", pushErrorReason(err))
+
+	// core.dry_run applies to every notification
+	ConfGaurun.Core.DryRun = true
+	req = RequestGaurunNotification{Tokens: []string{"token"}, Platform: PlatFormAndroid, Message: "hello"}
+	assert.NoError(t, pushNotificationAndroid(req))
+	messages := fcm.Messages()
+	require.Len(t, messages, 1)
+	assert.True(t, messages[0].Message.DryRun)
+
+	req.Platform = PlatFormIos
+	req.Tokens = []string{token}
+	assert.NoError(t, pushNotificationIos(req))
+	assert.Empty(t, apns.Pushes())
+}
@@ -1,13 +1,17 @@
 package gaurun
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
 
+	"github.com/mercari/gaurun/gcm"
 	"github.com/pelletier/go-toml"
 )
 
@@ -16,48 +20,95 @@ type ConfToml struct {
 	Android SectionAndroid `toml:"android"`
 	Ios     SectionIos     `toml:"ios"`
 	Log     SectionLog     `toml:"log"`
+	Trace   SectionTrace   `toml:"trace"`
+	Auth    SectionAuth    `toml:"auth"`
 }
 
 type SectionCore struct {
-	Port               string `toml:"port"`
-	WorkerNum          int64  `toml:"workers"`
-	QueueNum           int64  `toml:"queues"`
-	NotificationMax    int64  `toml:"notification_max"`
-	PusherMax          int64  `toml:"pusher_max"`
-	ShutdownTimeout    int64  `toml:"shutdown_timeout"`
-	Pid                string `toml:"pid"`
-	AllowsEmptyMessage bool   `toml:"allows_empty_message"`
+	Port                 string  `toml:"port"`
+	WorkerNum            int64   `toml:"workers"`
+	QueueNum             int64   `toml:"queues"`
+	NotificationMax      int64   `toml:"notification_max"`
+	PusherMax            int64   `toml:"pusher_max"`
+	ShutdownTimeout      int64   `toml:"shutdown_timeout"`
+	ShutdownDelay        int64   `toml:"shutdown_delay"`
+	Pid                  string  `toml:"pid"`
+	AllowsEmptyMessage   bool    `toml:"allows_empty_message"`
+	QueueSaturationRatio float64 `toml:"queue_saturation_ratio"`
+	QueueFile            string  `toml:"queue_file"`
+	PauseHoldMax         int64   `toml:"pause_hold_max"`
+	DryRun               bool    `toml:"dry_run"`
+	NormalizeToken       bool    `toml:"normalize_token"`
+	Truncate             bool    `toml:"truncate"`
 }
 
 type SectionAndroid struct {
 	Enabled          bool   `toml:"enabled"`
 	ApiKey           string `toml:"apikey"`
+	ApiKeyFile       string `toml:"apikey_file"`
 	Timeout          int    `toml:"timeout"`
 	KeepAliveTimeout int    `toml:"keepalive_timeout"`
 	KeepAliveConns   int    `toml:"keepalive_conns"`
 	RetryMax         int    `toml:"retry_max"`
+	Endpoint         string `toml:"endpoint"`
 }
 
 type SectionIos struct {
-	Enabled          bool   `toml:"enabled"`
-	PemCertPath      string `toml:"pem_cert_path"`
-	PemKeyPath       string `toml:"pem_key_path"`
-	PemKeyPassphrase string `toml:"pem_key_passphrase"`
-	TokenAuthKeyPath string `toml:"token_auth_key_path"`
-	TokenAuthKeyID   string `toml:"token_auth_key_id"`
-	TokenAuthTeamID  string `toml:"token_auth_team_id"`
-	Sandbox          bool   `toml:"sandbox"`
-	RetryMax         int    `toml:"retry_max"`
-	Timeout          int    `toml:"timeout"`
-	KeepAliveTimeout int    `toml:"keepalive_timeout"`
-	KeepAliveConns   int    `toml:"keepalive_conns"`
-	Topic            string `toml:"topic"`
+	Enabled              bool   `toml:"enabled"`
+	PemCertPath          string `toml:"pem_cert_path"`
+	PemCertBase64        string `toml:"pem_cert_base64"`
+	PemKeyPath           string `toml:"pem_key_path"`
+	PemKeyBase64         string `toml:"pem_key_base64"`
+	PemKeyPassphrase     string `toml:"pem_key_passphrase"`
+	PemKeyPassphraseFile string `toml:"pem_key_passphrase_file"`
+	P12Path              string `toml:"p12_path"`
+	P12Base64            string `toml:"p12_base64"`
+	P12Passphrase        string `toml:"p12_passphrase"`
+	P12PassphraseFile    string `toml:"p12_passphrase_file"`
+	TokenAuthKeyPath     string `toml:"token_auth_key_path"`
+	TokenAuthKeyBase64   string `toml:"token_auth_key_base64"`
+	TokenAuthKeyID       string `toml:"token_auth_key_id"`
+	TokenAuthTeamID      string `toml:"token_auth_team_id"`
+	Sandbox              bool   `toml:"sandbox"`
+	RetryMax             int    `toml:"retry_max"`
+	Timeout              int    `toml:"timeout"`
+	KeepAliveTimeout     int    `toml:"keepalive_timeout"`
+	KeepAliveConns       int    `toml:"keepalive_conns"`
+	Topic                string `toml:"topic"`
+	Endpoint             string `toml:"endpoint"`
+	RootCAPath           string `toml:"root_ca_path"`
 }
 
 type SectionLog struct {
-	AccessLog string `toml:"access_log"`
-	ErrorLog  string `toml:"error_log"`
-	Level     string `toml:"level"`
+	AccessLog        string `toml:"access_log"`
+	ErrorLog         string `toml:"error_log"`
+	Level            string `toml:"level"`
+	TokenMask        string `toml:"token_mask"`
+	TokenHashKey     string `toml:"token_hash_key"`
+	TokenHashKeyFile string `toml:"token_hash_key_file"`
+	Content          string `toml:"content"`
+	PayloadLog       string `toml:"payload_log"`
+	AuditLog         string `toml:"audit_log"`
+	Format           string `toml:"format"`
+	RotateSize       int64  `toml:"rotate_size"`
+	RotateInterval   string `toml:"rotate_interval"`
+	RotateBackups    int    `toml:"rotate_backups"`
+	RotateMaxAge     int    `toml:"rotate_max_age"`
+}
+
+type SectionTrace struct {
+	Exporter    string  `toml:"exporter"`
+	Endpoint    string  `toml:"endpoint"`
+	URLPath     string  `toml:"url_path"`
+	Insecure    bool    `toml:"insecure"`
+	SampleRatio float64 `toml:"sample_ratio"`
+	ServiceName string  `toml:"service_name"`
+}
+
+type SectionAuth struct {
+	KeysFile     string `toml:"keys_file"`
+	MaxClockSkew int64  `toml:"max_clock_skew"`
+	MaxBodySize  int64  `toml:"max_body_size"`
 }
 
 func BuildDefaultConf() ConfToml {
@@ -71,8 +122,15 @@ func BuildDefaultConf() ConfToml {
 	conf.Core.NotificationMax = 100
 	conf.Core.PusherMax = 0
 	conf.Core.ShutdownTimeout = 10
+	conf.Core.ShutdownDelay = 0
 	conf.Core.Pid = ""
 	conf.Core.AllowsEmptyMessage = false
+	conf.Core.QueueSaturationRatio = 0.9
+	conf.Core.QueueFile = ""
+	conf.Core.PauseHoldMax = 65536
+	conf.Core.DryRun = false
+	conf.Core.NormalizeToken = false
+	conf.Core.Truncate = false
 	// Android
 	conf.Android.ApiKey = ""
 	conf.Android.Enabled = true
@@ -80,6 +138,7 @@ func BuildDefaultConf() ConfToml {
 	conf.Android.KeepAliveTimeout = 90
 	conf.Android.KeepAliveConns = numCPU
 	conf.Android.RetryMax = 1
+	conf.Android.Endpoint = gcm.FCMSendEndpoint
 	// iOS
 	conf.Ios.Enabled = true
 	conf.Ios.PemCertPath = ""
@@ -93,10 +152,33 @@ func BuildDefaultConf() ConfToml {
 	conf.Ios.KeepAliveTimeout = 90
 	conf.Ios.KeepAliveConns = numCPU
 	conf.Ios.Topic = ""
+	conf.Ios.Endpoint = ""
+	conf.Ios.RootCAPath = ""
 	// log
 	conf.Log.AccessLog = "stdout"
 	conf.Log.ErrorLog = "stderr"
 	conf.Log.Level = "error"
+	conf.Log.TokenMask = LogTokenMaskNone
+	conf.Log.TokenHashKey = ""
+	conf.Log.Content = LogContentFull
+	conf.Log.PayloadLog = ""
+	conf.Log.AuditLog = ""
+	conf.Log.Format = LogFormatJSON
+	conf.Log.RotateSize = 0
+	conf.Log.RotateInterval = ""
+	conf.Log.RotateBackups = 0
+	conf.Log.RotateMaxAge = 0
+	// trace
+	conf.Trace.Exporter = "none"
+	conf.Trace.Endpoint = "localhost:4318"
+	conf.Trace.URLPath = "/v1/traces"
+	conf.Trace.Insecure = false
+	conf.Trace.SampleRatio = 1.0
+	conf.Trace.ServiceName = "gaurun"
+	// auth
+	conf.Auth.KeysFile = ""
+	conf.Auth.MaxClockSkew = 300
+	conf.Auth.MaxBodySize = 10
 	return conf
 }
 
@@ -112,6 +194,127 @@ func LoadConf(confGaurun ConfToml, confPath string) (ConfToml, error) {
 	return confGaurun, nil
 }
 
+// BuildConf builds the configuration from the defaults, the file in confPath
+// and the environment variables in order. The file can be omitted when every
+// parameter is given by environment variables.
+func BuildConf(confPath string, lookupEnv func(string) (string, bool)) (ConfToml, error) {
+	conf := BuildDefaultConf()
+
+	var err error
+	if confPath != "" {
+		conf, err = LoadConf(conf, confPath)
+		if err != nil {
+			return conf, err
+		}
+	}
+
+	// overwrite by environment variables (GAURUN_<SECTION>_<KEY>)
+	return LoadConfEnv(conf, lookupEnv)
+}
+
+// LoadConfEnv overwrites confGaurun with environment variables named
+// GAURUN_<SECTION>_<KEY> (e.g. GAURUN_CORE_WORKERS, GAURUN_IOS_SANDBOX).
+func LoadConfEnv(confGaurun ConfToml, lookupEnv func(string) (string, bool)) (ConfToml, error) {
+	var err error
+	walkConf(&confGaurun, func(name string, field reflect.Value) {
+		if err != nil {
+			return
+		}
+		envName := "GAURUN_" + strings.ToUpper(strings.Replace(name, ".", "_", -1))
+		value, ok := lookupEnv(envName)
+		if !ok {
+			return
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, perr := strconv.ParseBool(value)
+			if perr != nil {
+				err = fmt.Errorf("%s must be a boolean: %q", envName, value)
+				return
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, perr := strconv.ParseInt(value, 10, 64)
+			if perr != nil {
+				err = fmt.Errorf("%s must be an integer: %q", envName, value)
+				return
+			}
+			field.SetInt(n)
+		case reflect.Float64:
+			f, perr := strconv.ParseFloat(value, 64)
+			if perr != nil {
+				err = fmt.Errorf("%s must be a number: %q", envName, value)
+				return
+			}
+			field.SetFloat(f)
+		}
+	})
+	return confGaurun, err
+}
+
+// LoadConfSecretFiles reads the secrets given by *_file keys into the
+// corresponding keys so that secrets do not have to be written in the
+// configuration file. Trailing newlines in the files are ignored.
+func LoadConfSecretFiles(confGaurun ConfToml) (ConfToml, error) {
+	secretFiles := []struct {
+		path   string
+		secret *string
+	}{
+		{confGaurun.Android.ApiKeyFile, &confGaurun.Android.ApiKey},
+		{confGaurun.Ios.PemKeyPassphraseFile, &confGaurun.Ios.PemKeyPassphrase},
+		{confGaurun.Ios.P12PassphraseFile, &confGaurun.Ios.P12Passphrase},
+		{confGaurun.Log.TokenHashKeyFile, &confGaurun.Log.TokenHashKey},
+	}
+	for _, f := range secretFiles {
+		if f.path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return confGaurun, err
+		}
+		*f.secret = strings.TrimRight(string(b), "\r\n")
+	}
+	return confGaurun, nil
+}
+
+// Redacted returns the configuration as flat key-value pairs
+// (e.g. "core.port") with the secrets masked, for logging.
+func (conf ConfToml) Redacted() map[string]interface{} {
+	secrets := map[string]bool{
+		"android.apikey":            true,
+		"ios.pem_key_base64":        true,
+		"ios.pem_key_passphrase":    true,
+		"ios.p12_base64":            true,
+		"ios.p12_passphrase":        true,
+		"ios.token_auth_key_base64": true,
+		"log.token_hash_key":        true,
+	}
+	values := make(map[string]interface{})
+	walkConf(&conf, func(name string, field reflect.Value) {
+		if secrets[name] && field.String() != "" {
+			values[name] = "<redacted>"
+			return
+		}
+		values[name] = field.Interface()
+	})
+	return values
+}
+
+// walkConf calls fn for every key of conf with its dotted name.
+func walkConf(conf *ConfToml, fn func(name string, field reflect.Value)) {
+	sections := reflect.ValueOf(conf).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		sectionName := sections.Type().Field(i).Tag.Get("toml")
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			fn(sectionName+"."+section.Type().Field(j).Tag.Get("toml"), section.Field(j))
+		}
+	}
+}
+
 func ConfigPushersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "PUT" {
 		sendResponse(w, "method must be PUT", http.StatusBadRequest)
@@ -150,15 +353,83 @@ func ConfigPushersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	atomic.StoreInt64(&ConfGaurun.Core.PusherMax, newPusherMax)
+	oldPusherMax := atomic.SwapInt64(&ConfGaurun.Core.PusherMax, newPusherMax)
+	LogAdminAction(r, "pushers", oldPusherMax, newPusherMax)
+
+	sendResponse(w, "ok", http.StatusOK)
+}
+
+// parseConfigNum returns the value of the parameter num, which must be
+// greater than 0 and less than or equal to max.
+func parseConfigNum(r *http.Request, max int64) (int64, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return 0, err
+	}
+	num, err := strconv.ParseInt(values.Get("num"), 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if num <= 0 {
+		return 0, fmt.Errorf("num must be greater than 0 (got %d)", num)
+	}
+	if num > max {
+		return 0, fmt.Errorf("num must be less than or equal to %d (got %d)", max, num)
+	}
+	return num, nil
+}
+
+// ConfigWorkersHandler adjusts the number of workers for push notification.
+func ConfigWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		sendResponse(w, "method must be PUT", http.StatusBadRequest)
+		return
+	}
+
+	newWorkerNum, err := parseConfigNum(r, MaxWorkerNum)
+	if err != nil {
+		LogError.Error(err.Error())
+		sendResponse(w, "malformed value", http.StatusBadRequest)
+		return
+	}
+
+	oldWorkerNum := atomic.LoadInt64(&ConfGaurun.Core.WorkerNum)
+	ResizeWorkers(newWorkerNum)
+	LogError.Info(fmt.Sprintf("resized workers to %d", newWorkerNum))
+	LogAdminAction(r, "workers", oldWorkerNum, newWorkerNum)
+
+	sendResponse(w, "ok", http.StatusOK)
+}
+
+// ConfigQueuesHandler migrates the internal queue to a new one with the given size.
+func ConfigQueuesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		sendResponse(w, "method must be PUT", http.StatusBadRequest)
+		return
+	}
+
+	newQueueNum, err := parseConfigNum(r, MaxQueueNum)
+	if err != nil {
+		LogError.Error(err.Error())
+		sendResponse(w, "malformed value", http.StatusBadRequest)
+		return
+	}
+
+	_, oldQueueNum := queueStat()
+	ResizeQueue(newQueueNum)
+	LogError.Info(fmt.Sprintf("resized queue to %d", newQueueNum))
+	LogAdminAction(r, "queues", int64(oldQueueNum), newQueueNum)
 
 	sendResponse(w, "ok", http.StatusOK)
 }
 
 func (s *SectionIos) IsTokenBasedProvider() bool {
-	return s.TokenAuthKeyPath != "" && s.TokenAuthKeyID != "" && s.TokenAuthTeamID != ""
+	return (s.TokenAuthKeyPath != "" || s.TokenAuthKeyBase64 != "") && s.TokenAuthKeyID != "" && s.TokenAuthTeamID != ""
 }
 
 func (s *SectionIos) IsCertificateBasedProvider() bool {
-	return s.PemCertPath != "" && s.PemKeyPath != ""
+	if s.P12Path != "" || s.P12Base64 != "" {
+		return true
+	}
+	return (s.PemCertPath != "" || s.PemCertBase64 != "") && (s.PemKeyPath != "" || s.PemKeyBase64 != "")
 }
@@ -1,10 +1,13 @@
 package gaurun
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -94,3 +97,83 @@ func (suite *ConfigTestSuite) TestValidateConf() {
 func TestConfigTestSuite(t *testing.T) {
 	suite.Run(t, new(ConfigTestSuite))
 }
+
+func TestLoadConfEnv(t *testing.T) {
+	env := map[string]string{
+		"GAURUN_CORE_PORT":       "unix:/tmp/gaurun.sock",
+		"GAURUN_CORE_WORKERS":    "16",
+		"GAURUN_IOS_SANDBOX":     "false",
+		"GAURUN_ANDROID_TIMEOUT": "10",
+		"GAURUN_LOG_LEVEL":       "debug",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	conf, err := LoadConfEnv(BuildDefaultConf(), lookupEnv)
+	assert.Nil(t, err)
+	assert.Equal(t, "unix:/tmp/gaurun.sock", conf.Core.Port)
+	assert.Equal(t, int64(16), conf.Core.WorkerNum)
+	assert.Equal(t, false, conf.Ios.Sandbox)
+	assert.Equal(t, 10, conf.Android.Timeout)
+	assert.Equal(t, "debug", conf.Log.Level)
+	assert.Equal(t, int64(8192), conf.Core.QueueNum)
+
+	env["GAURUN_CORE_QUEUES"] = "many"
+	_, err = LoadConfEnv(BuildDefaultConf(), lookupEnv)
+	assert.EqualError(t, err, `GAURUN_CORE_QUEUES must be an integer: "many"`)
+}
+
+func TestBuildConf(t *testing.T) {
+	env := map[string]string{"GAURUN_CORE_WORKERS": "16"}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	// without the configuration file
+	conf, err := BuildConf("", lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), conf.Core.WorkerNum)
+	assert.Equal(t, int64(8192), conf.Core.QueueNum)
+
+	// the environment variables take precedence over the file
+	path := filepath.Join(t.TempDir(), "gaurun.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("[core]\nworkers = 4\nqueues = 1024\n"), 0600))
+	conf, err = BuildConf(path, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), conf.Core.WorkerNum)
+	assert.Equal(t, int64(1024), conf.Core.QueueNum)
+
+	_, err = BuildConf(filepath.Join(t.TempDir(), "missing.toml"), lookupEnv)
+	assert.Error(t, err)
+}
+
+func TestLoadConfSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	apiKeyPath := filepath.Join(dir, "apikey")
+	assert.Nil(t, ioutil.WriteFile(apiKeyPath, []byte("secret apikey\n"), 0600))
+
+	conf := BuildDefaultConf()
+	conf.Android.ApiKeyFile = apiKeyPath
+	conf, err := LoadConfSecretFiles(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret apikey", conf.Android.ApiKey)
+	assert.Equal(t, "", conf.Ios.PemKeyPassphrase)
+
+	conf.Ios.PemKeyPassphraseFile = filepath.Join(dir, "missing")
+	_, err = LoadConfSecretFiles(conf)
+	assert.NotNil(t, err)
+}
+
+func TestConfRedacted(t *testing.T) {
+	conf := BuildDefaultConf()
+	conf.Android.ApiKey = "secret apikey"
+
+	values := conf.Redacted()
+	assert.Equal(t, "<redacted>", values["android.apikey"])
+	assert.Equal(t, "", values["ios.pem_key_passphrase"])
+	assert.Equal(t, "1056", values["core.port"])
+	assert.Equal(t, int64(8192), values["core.queues"])
+}
@@ -4,6 +4,13 @@ const (
 	Version = "0.14.0"
 )
 
+const (
+	// MaxWorkerNum and MaxQueueNum limit the number of workers and the size
+	// of the queue given by the configuration or PUT /config/*.
+	MaxWorkerNum = 4096
+	MaxQueueNum  = 1 << 20
+)
+
 const (
 	PlatFormIos = iota + 1
 	PlatFormAndroid
@@ -14,9 +21,48 @@ const (
 	StatusSucceededPush = "succeeded-push"
 	StatusFailedPush    = "failed-push"
 	StatusDisabledPush  = "disabled-push"
+	StatusPausedPush    = "paused-push"
+	StatusDryRunPush    = "dryrun-push"
+	StatusSavedPush     = "saved-push"
+)
+
+const (
+	TraceExporterNone     = "none"
+	TraceExporterStdout   = "stdout"
+	TraceExporterOTLPHTTP = "otlphttp"
+)
+
+const (
+	LogTokenMaskNone     = "none"
+	LogTokenMaskHash     = "hash"
+	LogTokenMaskTruncate = "truncate"
+)
+
+const (
+	AuthScopePush  = "push"
+	AuthScopeStat  = "stat"
+	AuthScopeAdmin = "admin"
+)
+
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+	LogFormatLTSV    = "ltsv"
+)
+
+const (
+	LogRotateHourly = "hourly"
+	LogRotateDaily  = "daily"
+)
+
+const (
+	LogContentFull   = "full"
+	LogContentRedact = "redact"
+	LogContentOmit   = "omit"
 )
 
 const (
 	ApnsPushTypeAlert      = "alert"
 	ApnsPushTypeBackground = "background"
+	ApnsPushTypeVoIP       = "voip"
 )
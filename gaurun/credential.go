@@ -0,0 +1,127 @@
+package gaurun
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mercari/gaurun/buford/token"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// loadCredential returns the credential given either as a file path or as
+// a base64 encoded string. name is used in error messages.
+func loadCredential(name, path, base64Value string) ([]byte, error) {
+	if path != "" && base64Value != "" {
+		return nil, fmt.Errorf("only one of the file path or the base64 value can be specified for %s", name)
+	}
+	if base64Value != "" {
+		b, err := base64.StdEncoding.DecodeString(base64Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 value of %s: %v", name, err)
+		}
+		return b, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s is not specified", name)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// LoadApnsCertificate loads the client certificate for certificate-based
+// provider connection trust. The certificate is given either as a PKCS#12
+// (.p12) bundle or as a pair of PEM encoded certificate and key.
+func LoadApnsCertificate(s *SectionIos) (tls.Certificate, error) {
+	if s.P12Path != "" || s.P12Base64 != "" {
+		if s.PemCertPath != "" || s.PemCertBase64 != "" || s.PemKeyPath != "" || s.PemKeyBase64 != "" {
+			return tls.Certificate{}, fmt.Errorf("only one of p12 or pem cert and key can be specified")
+		}
+		p12, err := loadCredential("p12", s.P12Path, s.P12Base64)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return certificateFromP12(p12, s.P12Passphrase)
+	}
+
+	certPEMBlock, err := loadCredential("pem cert", s.PemCertPath, s.PemCertBase64)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEMBlock, err := loadCredential("pem key", s.PemKeyPath, s.PemKeyBase64)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return x509KeyPairWithPassword(certPEMBlock, keyPEMBlock, s.PemKeyPassphrase)
+}
+
+// LoadApnsAuthKey loads the APNs auth key (.p8) for token-based provider
+// connection trust.
+func LoadApnsAuthKey(s *SectionIos) (*ecdsa.PrivateKey, error) {
+	authKey, err := loadCredential("token auth key", s.TokenAuthKeyPath, s.TokenAuthKeyBase64)
+	if err != nil {
+		return nil, err
+	}
+	return token.AuthKeyFromBytes(authKey)
+}
+
+func x509KeyPairWithPassword(certPEMBlock, keyPEMBlock []byte, keyPassphrase string) (tls.Certificate, error) {
+	if keyPassphrase != "" {
+		pemBlock, _ := pem.Decode(keyPEMBlock)
+		if pemBlock == nil {
+			return tls.Certificate{}, fmt.Errorf("failed to decode PEM block of the key")
+		}
+		if !x509.IsEncryptedPEMBlock(pemBlock) {
+			return tls.Certificate{}, fmt.Errorf("the key is not encrypted. passphrase is not required")
+		}
+		decrypted, err := x509.DecryptPEMBlock(pemBlock, []byte(keyPassphrase))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyPEMBlock = pem.EncodeToMemory(&pem.Block{Type: pemBlock.Type, Bytes: decrypted})
+	}
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+}
+
+// certificateFromP12 decodes a PKCS#12 bundle. The bundle may contain the
+// intermediate certificates in any order, so the leaf certificate is the
+// one which matches the private key.
+func certificateFromP12(p12 []byte, passphrase string) (tls.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(p12, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decode p12: %v", err)
+	}
+
+	var (
+		certBlocks [][]byte
+		keyPEM     []byte
+	)
+	for _, b := range blocks {
+		switch b.Type {
+		case "CERTIFICATE":
+			certBlocks = append(certBlocks, pem.EncodeToMemory(&pem.Block{Type: b.Type, Bytes: b.Bytes}))
+		case "PRIVATE KEY":
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: b.Type, Bytes: b.Bytes})
+		}
+	}
+	if keyPEM == nil {
+		return tls.Certificate{}, fmt.Errorf("p12 does not contain a private key")
+	}
+
+	for i, leaf := range certBlocks {
+		chain := append([]byte{}, leaf...)
+		for j, other := range certBlocks {
+			if i != j {
+				chain = append(chain, other...)
+			}
+		}
+		if cert, err := tls.X509KeyPair(chain, keyPEM); err == nil {
+			return cert, nil
+		}
+	}
+	return tls.Certificate{}, fmt.Errorf("p12 does not contain a certificate which matches the private key")
+}
@@ -0,0 +1,71 @@
+package gaurun
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestdataBase64(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestLoadApnsCertificate(t *testing.T) {
+	cases := []struct {
+		Name string
+		Conf SectionIos
+	}{
+		{"pem path", SectionIos{PemCertPath: "testdata/apns-cert.pem", PemKeyPath: "testdata/apns-key.pem"}},
+		{"pem base64", SectionIos{PemCertBase64: readTestdataBase64(t, "apns-cert.pem"), PemKeyBase64: readTestdataBase64(t, "apns-key.pem")}},
+		{"p12 path", SectionIos{P12Path: "testdata/apns.p12", P12Passphrase: "gaurun"}},
+		{"p12 base64", SectionIos{P12Base64: readTestdataBase64(t, "apns.p12"), P12Passphrase: "gaurun"}},
+	}
+
+	for _, c := range cases {
+		assert.True(t, c.Conf.IsCertificateBasedProvider(), c.Name)
+		cert, err := LoadApnsCertificate(&c.Conf)
+		require.NoError(t, err, c.Name)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err, c.Name)
+		assert.Equal(t, "com.example.gaurun", (&ApnsCredentialInfo{Certificate: leaf}).Topic(), c.Name)
+	}
+}
+
+func TestLoadApnsCertificateError(t *testing.T) {
+	cases := []struct {
+		Name string
+		Conf SectionIos
+	}{
+		{"wrong p12 passphrase", SectionIos{P12Path: "testdata/apns.p12", P12Passphrase: "wrong"}},
+		{"both p12 and pem", SectionIos{P12Path: "testdata/apns.p12", PemCertPath: "testdata/apns-cert.pem", PemKeyPath: "testdata/apns-key.pem"}},
+		{"both path and base64", SectionIos{PemCertPath: "testdata/apns-cert.pem", PemCertBase64: readTestdataBase64(t, "apns-cert.pem"), PemKeyPath: "testdata/apns-key.pem"}},
+		{"malformed base64", SectionIos{PemCertBase64: "!!!", PemKeyPath: "testdata/apns-key.pem"}},
+		{"unnecessary passphrase", SectionIos{PemCertPath: "testdata/apns-cert.pem", PemKeyPath: "testdata/apns-key.pem", PemKeyPassphrase: "gaurun"}},
+	}
+
+	for _, c := range cases {
+		_, err := LoadApnsCertificate(&c.Conf)
+		assert.Error(t, err, c.Name)
+	}
+}
+
+func TestLoadApnsAuthKey(t *testing.T) {
+	conf := SectionIos{TokenAuthKeyBase64: readTestdataBase64(t, "authkey.p8"), TokenAuthKeyID: "key-id", TokenAuthTeamID: "team-id"}
+	assert.True(t, conf.IsTokenBasedProvider())
+	_, err := LoadApnsAuthKey(&conf)
+	assert.NoError(t, err)
+
+	conf = SectionIos{TokenAuthKeyPath: "testdata/authkey.p8"}
+	_, err = LoadApnsAuthKey(&conf)
+	assert.NoError(t, err)
+
+	conf = SectionIos{TokenAuthKeyBase64: readTestdataBase64(t, "apns-cert.pem")}
+	_, err = LoadApnsAuthKey(&conf)
+	assert.Error(t, err)
+}
@@ -19,6 +19,12 @@ var (
 	// access and error logger
 	LogAccess *zap.Logger
 	LogError  *zap.Logger
+	// level of the error logger, which can be changed at runtime
+	LogErrorLevel = zap.NewAtomicLevelAt(zap.ErrorLevel)
+	// logger of the full payloads for gaurun_recover, nil if disabled
+	LogPayload *zap.Logger
+	// logger of the administrative actions, nil if disabled
+	LogAudit *zap.Logger
 	// sequence ID for numbering push
 	SeqID uint64
 )
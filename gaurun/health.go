@@ -0,0 +1,134 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set to 1 when graceful shutdown begins.
+var shuttingDown int32
+
+type ResponseHealth struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// BeginShutdown makes the readiness check fail so that load balancers stop
+// sending new requests before the server stops.
+func BeginShutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func checkShutdown() HealthCheck {
+	if isShuttingDown() {
+		return HealthCheck{Name: "shutdown", OK: false, Message: "server is shutting down"}
+	}
+	return HealthCheck{Name: "shutdown", OK: true}
+}
+
+func checkQueue() HealthCheck {
+	usage, max := queueStat()
+	msg := fmt.Sprintf("%d/%d", usage, max)
+	if max == 0 {
+		return HealthCheck{Name: "queue", OK: false, Message: "queue is not initialized"}
+	}
+	if float64(usage)/float64(max) > ConfGaurun.Core.QueueSaturationRatio {
+		return HealthCheck{Name: "queue", OK: false, Message: fmt.Sprintf("queue is saturated: %s", msg)}
+	}
+	return HealthCheck{Name: "queue", OK: true, Message: msg}
+}
+
+func checkHeld() HealthCheck {
+	held := pauseIos.heldCount()
+	if n := pauseAndroid.heldCount(); n > held {
+		held = n
+	}
+	max := ConfGaurun.Core.PauseHoldMax
+	msg := fmt.Sprintf("%d/%d", held, max)
+	if float64(held)/float64(max) > ConfGaurun.Core.QueueSaturationRatio {
+		return HealthCheck{Name: "held", OK: false, Message: fmt.Sprintf("held notifications are saturated: %s", msg)}
+	}
+	return HealthCheck{Name: "held", OK: true, Message: msg}
+}
+
+func checkAPNs() HealthCheck {
+	if APNSClient.HTTPClient == nil {
+		return HealthCheck{Name: "apns", OK: false, Message: "client for APNs is not loaded"}
+	}
+	if cert := APNSClient.Certificate; cert != nil {
+		if time.Now().After(cert.NotAfter) {
+			return HealthCheck{Name: "apns", OK: false, Message: fmt.Sprintf("certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))}
+		}
+		return HealthCheck{Name: "apns", OK: true, Message: fmt.Sprintf("certificate expires at %s", cert.NotAfter.UTC().Format(time.RFC3339))}
+	}
+	if APNSClient.Token == nil || APNSClient.Token.AuthKey == nil {
+		return HealthCheck{Name: "apns", OK: false, Message: "auth key for APNs is not loaded"}
+	}
+	return HealthCheck{Name: "apns", OK: true}
+}
+
+func checkFCM() HealthCheck {
+	if GCMClient == nil || GCMClient.ApiKey == "" {
+		return HealthCheck{Name: "fcm", OK: false, Message: "API key for FCM is missing"}
+	}
+	return HealthCheck{Name: "fcm", OK: true}
+}
+
+func sendHealthResponse(w http.ResponseWriter, result ResponseHealth) {
+	code := http.StatusOK
+	if result.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	respBody, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		msg := "Response-body could not be created"
+		LogError.Error(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+	w.WriteHeader(code)
+	w.Write(respBody)
+}
+
+// LivenessHandler responds while the process is able to serve HTTP.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	sendHealthResponse(w, ResponseHealth{Status: "ok"})
+}
+
+// ReadinessHandler responds whether Gaurun is able to accept push notifications.
+// It responds 503 with the failed checks during graceful shutdown, when the
+// queue or the notifications held while paused are saturated, or when the credentials of the enabled platforms are unavailable.
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := []HealthCheck{checkShutdown(), checkQueue(), checkHeld()}
+	if ConfGaurun.Ios.Enabled {
+		checks = append(checks, checkAPNs())
+	}
+	if ConfGaurun.Android.Enabled {
+		checks = append(checks, checkFCM())
+	}
+
+	result := ResponseHealth{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			result.Status = "unavailable"
+		}
+	}
+	sendHealthResponse(w, result)
+}
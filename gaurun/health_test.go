@@ -0,0 +1,99 @@
+package gaurun
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mercari/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getReadiness(t *testing.T) (int, ResponseHealth) {
+	w := httptest.NewRecorder()
+	ReadinessHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	var result ResponseHealth
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return w.Code, result
+}
+
+func failedChecks(result ResponseHealth) []string {
+	var names []string
+	for _, c := range result.Checks {
+		if !c.OK {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	LivenessHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestReadinessHandler(t *testing.T) {
+	origConf, origQueue, origAPNS, origGCM := ConfGaurun, QueueNotification, APNSClient, GCMClient
+	defer func() {
+		ConfGaurun, QueueNotification, APNSClient, GCMClient = origConf, origQueue, origAPNS, origGCM
+		atomic.StoreInt32(&shuttingDown, 0)
+	}()
+
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Core.QueueSaturationRatio = 0.5
+	QueueNotification = make(chan RequestGaurunNotification, 4)
+	APNSClient = APNsClient{
+		HTTPClient:  &http.Client{},
+		Certificate: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)},
+	}
+	var err error
+	GCMClient, err = gcm.NewClient(gcm.FCMSendEndpoint, "apikey")
+	require.NoError(t, err)
+
+	code, result := getReadiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", result.Status)
+	assert.Empty(t, failedChecks(result))
+
+	QueueNotification <- RequestGaurunNotification{}
+	QueueNotification <- RequestGaurunNotification{}
+	QueueNotification <- RequestGaurunNotification{}
+	code, result = getReadiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", result.Status)
+	assert.Equal(t, []string{"queue"}, failedChecks(result))
+	QueueNotification = make(chan RequestGaurunNotification, 4)
+
+	ConfGaurun.Core.PauseHoldMax = 2
+	pauseAndroid.pause()
+	pauseAndroid.hold(RequestGaurunNotification{}, 2)
+	pauseAndroid.hold(RequestGaurunNotification{}, 2)
+	code, result = getReadiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"held"}, failedChecks(result))
+	pauseAndroid.resume()
+
+	APNSClient.Certificate.NotAfter = time.Now().Add(-time.Hour)
+	GCMClient.ApiKey = ""
+	_, result = getReadiness(t)
+	assert.Equal(t, []string{"apns", "fcm"}, failedChecks(result))
+
+	// checks of the disabled platforms are skipped
+	ConfGaurun.Ios.Enabled = false
+	ConfGaurun.Android.Enabled = false
+	code, _ = getReadiness(t)
+	assert.Equal(t, http.StatusOK, code)
+
+	BeginShutdown()
+	code, result = getReadiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"shutdown"}, failedChecks(result))
+}
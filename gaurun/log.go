@@ -1,9 +1,11 @@
 package gaurun
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"os"
 	"sync/atomic"
 	"time"
 
@@ -15,28 +17,45 @@ import (
 type LogReq struct {
 	Type          string `json:"type"`
 	Time          string `json:"time"`
+	RequestID     string `json:"request_id,omitempty"`
 	URI           string `json:"uri"`
 	Method        string `json:"method"`
 	Proto         string `json:"proto"`
 	ContentLength int64  `json:"content_length"`
+	// completed-request only
+	RemoteAddr    string  `json:"remote_addr,omitempty"`
+	XForwardedFor string  `json:"x_forwarded_for,omitempty"`
+	Status        int     `json:"status,omitempty"`
+	Size          int64   `json:"size,omitempty"`
+	Latency       float64 `json:"latency,omitempty"`
+	Notifications int     `json:"notifications,omitempty"`
 }
 
 type LogPushEntry struct {
-	Type     string  `json:"type"`
-	Time     string  `json:"time"`
-	ID       uint64  `json:"id"`
-	Platform string  `json:"platform"`
-	Token    string  `json:"token"`
-	Message  string  `json:"message"`
-	Ptime    float64 `json:"ptime"`
-	Error    string  `json:"error"`
+	Type       string       `json:"type"`
+	Time       string       `json:"time"`
+	ID         uint64       `json:"id"`
+	Platform   string       `json:"platform"`
+	Token      string       `json:"token"`
+	Message    string       `json:"message"`
+	Ptime      float64      `json:"ptime"`
+	Error      string       `json:"error"`
+	Identifier string       `json:"identifier,omitempty"`
+	Extend     []ExtendJSON `json:"extend,omitempty"`
+	DryRun     bool         `json:"dry_run,omitempty"`
+	Truncated  bool         `json:"truncated,omitempty"`
+	RequestID  string       `json:"request_id,omitempty"`
+	MessageID  string       `json:"message_id,omitempty"`
 	// Android
 	CollapseKey    string `json:"collapse_key,omitempty"`
 	DelayWhileIdle bool   `json:"delay_while_idle,omitempty"`
 	TimeToLive     int    `json:"time_to_live,omitempty"`
+	Priority       string `json:"priority,omitempty"`
 	// iOS
 	Title            string `json:"title,omitempty"`
 	Subtitle         string `json:"subtitle,omitempty"`
+	PushType         string `json:"push_type,omitempty"`
+	ApnsID           string `json:"apns_id,omitempty"`
 	Badge            int    `json:"badge,omitempty"`
 	Category         string `json:"category,omitempty"`
 	Sound            string `json:"sound,omitempty"`
@@ -45,51 +64,149 @@ type LogPushEntry struct {
 	Expiry           int    `json:"expiry,omitempty"`
 }
 
+// Request rebuilds the push notification logged as the entry.
+func (e LogPushEntry) Request() (RequestGaurunNotification, error) {
+	var platform int
+	switch e.Platform {
+	case "ios":
+		platform = PlatFormIos
+	case "android":
+		platform = PlatFormAndroid
+	default:
+		return RequestGaurunNotification{}, fmt.Errorf("invalid platform: %q", e.Platform)
+	}
+
+	return RequestGaurunNotification{
+		Tokens:           []string{e.Token},
+		Platform:         platform,
+		Message:          e.Message,
+		Identifier:       e.Identifier,
+		CollapseKey:      e.CollapseKey,
+		DelayWhileIdle:   e.DelayWhileIdle,
+		TimeToLive:       e.TimeToLive,
+		Priority:         e.Priority,
+		Title:            e.Title,
+		Subtitle:         e.Subtitle,
+		PushType:         e.PushType,
+		ApnsID:           e.ApnsID,
+		Badge:            e.Badge,
+		Category:         e.Category,
+		Sound:            e.Sound,
+		ContentAvailable: e.ContentAvailable,
+		MutableContent:   e.MutableContent,
+		Expiry:           e.Expiry,
+		Extend:           e.Extend,
+		DryRun:           e.DryRun,
+		Truncated:        e.Truncated,
+		RequestID:        e.RequestID,
+		ID:               e.ID,
+	}, nil
+}
+
+// ParseLogTime parses the time of the log entry written by LocalTimeEncoder.
+func ParseLogTime(s string) (time.Time, error) {
+	return time.ParseInLocation(LogTimeLayout, s, time.Local)
+}
+
 type Reopener interface {
 	Reopen() error
 }
 
+// LogTimeLayout is the layout of the time in logs
+const LogTimeLayout = "2006/01/02 15:04:05 MST"
+
 func LocalTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
-	enc.AppendString(t.Format("2006/01/02 15:04:05 MST"))
+	enc.AppendString(t.Format(LogTimeLayout))
 }
 
 func InitLog(outString, levelString string) (*zap.Logger, Reopener, error) {
-	var writer reopen.Writer
-	switch outString {
-	case "stdout":
+	return InitLogMode(outString, levelString, 0644)
+}
+
+// InitLogMode is like InitLog but creates the log file with perm.
+func InitLogMode(outString, levelString string, perm os.FileMode) (*zap.Logger, Reopener, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(levelString)); err != nil {
+		return nil, nil, err
+	}
+	return newLogger(outString, level, perm, ConfGaurun.Log)
+}
+
+// InitJSONLog is like InitLog but always writes JSON without rotation,
+// regardless of the log section of the configuration.
+func InitJSONLog(outString, levelString string) (*zap.Logger, Reopener, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(levelString)); err != nil {
+		return nil, nil, err
+	}
+	return newLogger(outString, level, 0644, SectionLog{Format: LogFormatJSON})
+}
+
+// InitLogLevel is like InitLog but the level of the logger follows level,
+// which can be changed at runtime.
+func InitLogLevel(outString string, level zap.AtomicLevel) (*zap.Logger, Reopener, error) {
+	return newLogger(outString, level, 0644, ConfGaurun.Log)
+}
+
+// newLogger builds the logger writing to outString in conf.Format.
+// The files are rotated by Gaurun itself if conf.RotateSize or
+// conf.RotateInterval is set.
+func newLogger(outString string, level zapcore.LevelEnabler, perm os.FileMode, conf SectionLog) (*zap.Logger, Reopener, error) {
+	var (
+		writer       reopen.Writer
+		syslogWriter *syslogWriter
+	)
+	switch {
+	case outString == "stdout":
 		writer = reopen.Stdout
-	case "stderr":
+	case outString == "stderr":
 		writer = reopen.Stderr
-	case "discard":
+	case outString == "discard":
 		writer = reopen.Discard
+	case isSyslogOutput(outString):
+		w, err := newSyslogWriter(outString)
+		if err != nil {
+			return nil, nil, err
+		}
+		writer = w
+		syslogWriter = w
+	case conf.RotateSize > 0 || conf.RotateInterval != "":
+		w, err := newRotateWriter(outString, perm, conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		writer = w
 	default:
-		f, err := reopen.NewFileWriterMode(outString, 0644)
+		f, err := reopen.NewFileWriterMode(outString, perm)
 		if err != nil {
 			return nil, nil, err
 		}
 		writer = f
 	}
 
-	var level zapcore.Level
-	if err := level.UnmarshalText([]byte(levelString)); err != nil {
-		return nil, nil, err
-	}
-
 	cfg := zap.NewProductionConfig().EncoderConfig
 	cfg.TimeKey = "time"
 	cfg.MessageKey = "message"
 	cfg.EncodeTime = LocalTimeEncoder
 
-	encoder := zapcore.NewJSONEncoder(cfg)
+	var encoder zapcore.Encoder
+	switch conf.Format {
+	case LogFormatConsole:
+		encoder = zapcore.NewConsoleEncoder(cfg)
+	case LogFormatLTSV:
+		encoder = newLTSVEncoder(cfg)
+	default:
+		encoder = zapcore.NewJSONEncoder(cfg)
+	}
 	writeSyncer := zapcore.AddSync(writer)
-	logger := zap.New(
-		zapcore.NewCore(
-			encoder,
-			zapcore.Lock(writeSyncer),
-			level,
-		),
-		zap.ErrorOutput(writeSyncer),
-	)
+	var core zapcore.Core
+	if syslogWriter != nil {
+		// the severity of syslog follows the level of each entry
+		core = syslogWriter.core(encoder, level)
+	} else {
+		core = zapcore.NewCore(encoder, zapcore.Lock(writeSyncer), level)
+	}
+	logger := zap.New(core, zap.ErrorOutput(writeSyncer))
 
 	return logger, writer, nil
 }
@@ -99,9 +216,20 @@ func LogSetupFatal(err error) {
 	log.Fatal(err)
 }
 
+// LogEffectiveConf outputs the configuration in use with the secrets redacted.
+func LogEffectiveConf(conf ConfToml) {
+	LogError.Info("effective configuration", zap.Any("conf", conf.Redacted()))
+}
+
 func LogAcceptedRequest(r *http.Request) {
+	requestID := zap.Skip()
+	if id := requestIDFrom(r.Context()); id != "" {
+		requestID = zap.String("request_id", id)
+	}
+
 	LogAccess.Info("",
 		zap.String("type", "accepted-request"),
+		requestID,
 		zap.String("uri", r.URL.String()),
 		zap.String("method", r.Method),
 		zap.String("proto", r.Proto),
@@ -109,14 +237,81 @@ func LogAcceptedRequest(r *http.Request) {
 	)
 }
 
+// LogCompletedRequest outputs the log of the request after it is handled.
+// notifications is the number of the notifications in the request to
+// POST /push.
+func LogCompletedRequest(r *http.Request, requestID string, status int, size int64, latency float64, notifications int) {
+	xForwardedFor := zap.Skip()
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		xForwardedFor = zap.String("x_forwarded_for", xff)
+	}
+	notificationsField := zap.Skip()
+	if notifications > 0 {
+		notificationsField = zap.Int("notifications", notifications)
+	}
+
+	LogAccess.Info("",
+		zap.String("type", "completed-request"),
+		zap.String("request_id", requestID),
+		zap.String("uri", r.URL.String()),
+		zap.String("method", r.Method),
+		zap.String("proto", r.Proto),
+		zap.Int64("content_length", r.ContentLength),
+		zap.String("remote_addr", r.RemoteAddr),
+		xForwardedFor,
+		zap.Int("status", status),
+		zap.Int64("size", size),
+		zap.Float64("latency", math.Floor(latency*1000)/1000), // %.3f conversion
+		notificationsField,
+	)
+}
+
+// LogAuthFailure logs the request failed to authenticate for the reason.
+// key is the name of the API key if the request tells it.
+func LogAuthFailure(r *http.Request, key, reason string) {
+	xForwardedFor := zap.Skip()
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		xForwardedFor = zap.String("x_forwarded_for", xff)
+	}
+	keyField := zap.Skip()
+	if key != "" {
+		keyField = zap.String("key", key)
+	}
+
+	LogAccess.Info("",
+		zap.String("type", "auth-failure"),
+		zap.String("request_id", requestIDFrom(r.Context())),
+		zap.String("uri", r.URL.String()),
+		zap.String("method", r.Method),
+		zap.String("remote_addr", r.RemoteAddr),
+		xForwardedFor,
+		keyField,
+		zap.String("reason", reason),
+	)
+}
+
 func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
-	var plat string
-	switch req.Platform {
-	case PlatFormIos:
-		plat = "ios"
-	case PlatFormAndroid:
-		plat = "android"
+	switch status {
+	case StatusAcceptedPush, StatusSucceededPush, StatusPausedPush, StatusDryRunPush, StatusSavedPush:
+		LogPushTo(LogAccess, id, status, token, ptime, req, errPush)
+	case StatusFailedPush, StatusDisabledPush:
+		LogPushTo(LogError, id, status, token, ptime, req, errPush)
+	}
+	// the payload log keeps what the masked logs lack to recover
+	if status == StatusAcceptedPush && LogPayload != nil {
+		logPushTo(LogPayload, id, status, token, ptime, req, errPush)
 	}
+}
+
+// LogPushTo outputs the log of the push notification to logger. The entry
+// has every parameter to push the notification again, except the ones
+// masked by log.token_mask and log.content.
+func LogPushTo(l *zap.Logger, id uint64, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
+	logPushTo(l, id, status, MaskToken(token), ptime, MaskNotification(req), errPush)
+}
+
+func logPushTo(l *zap.Logger, id uint64, status, token string, ptime float64, req RequestGaurunNotification, errPush error) {
+	plat := platformName(req.Platform)
 
 	ptime = math.Floor(ptime*1000) / 1000 // %.3f conversion
 
@@ -130,11 +325,17 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	case StatusAcceptedPush:
 		fallthrough
 	case StatusSucceededPush:
-		logger = LogAccess.Info
+		fallthrough
+	case StatusPausedPush:
+		fallthrough
+	case StatusDryRunPush:
+		fallthrough
+	case StatusSavedPush:
+		logger = l.Info
 	case StatusFailedPush:
 		fallthrough
 	case StatusDisabledPush:
-		logger = LogError.Error
+		logger = l.Error
 	}
 
 	// omitempty request parameters handling.
@@ -146,6 +347,10 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	if req.DelayWhileIdle {
 		delayWhileIdle = zap.Bool("delay_while_idle", req.DelayWhileIdle)
 	}
+	priority := zap.Skip()
+	if req.Priority != "" {
+		priority = zap.String("priority", req.Priority)
+	}
 	timeToLive := zap.Skip()
 	if req.TimeToLive != 0 {
 		timeToLive = zap.Int("time_to_live", req.TimeToLive)
@@ -154,6 +359,10 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	if req.Title != "" {
 		title = zap.String("title", req.Title)
 	}
+	pushType := zap.Skip()
+	if req.PushType != "" {
+		pushType = zap.String("push_type", req.PushType)
+	}
 	subtitle := zap.Skip()
 	if req.Subtitle != "" {
 		subtitle = zap.String("subtitle", req.Subtitle)
@@ -186,6 +395,30 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 	if req.Identifier != "" {
 		identifier = zap.String("identifier", req.Identifier)
 	}
+	extend := zap.Skip()
+	if len(req.Extend) > 0 {
+		extend = zap.Any("extend", req.Extend)
+	}
+	dryRun := zap.Skip()
+	if req.DryRun {
+		dryRun = zap.Bool("dry_run", req.DryRun)
+	}
+	truncated := zap.Skip()
+	if req.Truncated {
+		truncated = zap.Bool("truncated", req.Truncated)
+	}
+	requestID := zap.Skip()
+	if req.RequestID != "" {
+		requestID = zap.String("request_id", req.RequestID)
+	}
+	apnsID := zap.Skip()
+	if req.ApnsID != "" {
+		apnsID = zap.String("apns_id", req.ApnsID)
+	}
+	messageID := zap.Skip()
+	if req.MessageID != "" {
+		messageID = zap.String("message_id", req.MessageID)
+	}
 
 	logger(req.Message,
 		zap.Uint64("id", id),
@@ -197,8 +430,10 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 		collapseKey,
 		delayWhileIdle,
 		timeToLive,
+		priority,
 		title,
 		subtitle,
+		pushType,
 		badge,
 		category,
 		sound,
@@ -206,9 +441,25 @@ func LogPush(id uint64, status, token string, ptime float64, req RequestGaurunNo
 		mutableContent,
 		expiry,
 		identifier,
+		extend,
+		dryRun,
+		truncated,
+		requestID,
+		apnsID,
+		messageID,
 	)
 }
 
+func platformName(platform int) string {
+	switch platform {
+	case PlatFormIos:
+		return "ios"
+	case PlatFormAndroid:
+		return "android"
+	}
+	return ""
+}
+
 func numberingPush() uint64 {
 	return atomic.AddUint64(&SeqID, 1)
 }
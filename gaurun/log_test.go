@@ -1,8 +1,16 @@
 package gaurun
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -40,3 +48,94 @@ func BenchmarkLogPushIOSFull(b *testing.B) {
 		LogPush(uint64(100), StatusAcceptedPush, "xxx", 0.123, req, errPush)
 	}
 }
+
+func TestLogPushEntryRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, _, err := InitLog(path, "info")
+	require.NoError(t, err)
+
+	reqs := []RequestGaurunNotification{
+		{
+			Tokens:         []string{"android-token"},
+			Platform:       PlatFormAndroid,
+			Message:        "hello",
+			Identifier:     "campaign",
+			CollapseKey:    "key",
+			DelayWhileIdle: true,
+			TimeToLive:     10,
+			Priority:       "high",
+			Extend:         []ExtendJSON{{Key: "url", Value: "https://example.com"}},
+			ID:             1,
+		},
+		{
+			Tokens:           []string{"ios-token"},
+			Platform:         PlatFormIos,
+			Message:          "hello",
+			Title:            "title",
+			Subtitle:         "subtitle",
+			PushType:         ApnsPushTypeBackground,
+			Badge:            1,
+			Category:         "category",
+			Sound:            "default",
+			ContentAvailable: true,
+			MutableContent:   true,
+			Expiry:           60,
+			DryRun:           true,
+			ID:               2,
+		},
+	}
+	now := time.Now()
+	for _, req := range reqs {
+		LogPushTo(logger, req.ID, StatusAcceptedPush, req.Tokens[0], 0, req, nil)
+	}
+	require.NoError(t, logger.Sync())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, len(reqs))
+
+	for i, line := range lines {
+		var entry LogPushEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, StatusAcceptedPush, entry.Type)
+
+		logTime, err := ParseLogTime(entry.Time)
+		require.NoError(t, err)
+		assert.WithinDuration(t, now, logTime, 2*time.Second)
+
+		req, err := entry.Request()
+		require.NoError(t, err)
+		assert.Equal(t, reqs[i], req)
+	}
+
+	_, err = LogPushEntry{Platform: "windows"}.Request()
+	assert.Error(t, err)
+}
+
+func TestInitJSONLog(t *testing.T) {
+	defer func(conf ConfToml) {
+		ConfGaurun = conf
+	}(ConfGaurun)
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Log.Format = LogFormatConsole
+
+	path := filepath.Join(t.TempDir(), "results.log")
+	logger, _, err := InitJSONLog(path, "info")
+	require.NoError(t, err)
+	for id := uint64(1); id <= 3; id++ {
+		LogPushTo(logger, id, StatusSucceededPush, "token", 0, RequestGaurunNotification{Platform: PlatFormIos}, nil)
+	}
+	require.NoError(t, logger.Sync())
+
+	// JSON even if log.format is console
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 3)
+	for _, line := range lines {
+		var entry LogPushEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, StatusSucceededPush, entry.Type)
+	}
+}
@@ -0,0 +1,136 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type ResponseLogLevel struct {
+	Level string `json:"level"`
+	// RevertsAt is the time the level is reverted at, if it is scheduled
+	RevertsAt string `json:"reverts_at,omitempty"`
+}
+
+// logLevelRevert reverts the level of the error logger changed with
+// PUT /config/loglevel after a while.
+type logLevelRevert struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	to    zapcore.Level
+	at    time.Time
+}
+
+var errorLogLevelRevert logLevelRevert
+
+// set changes the level to level. If after is positive, the level is
+// reverted after it to the one before the first change still in effect.
+func (r *logLevelRevert) set(level zapcore.Level, after time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	to := LogErrorLevel.Level()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+		to = r.to
+	}
+	LogErrorLevel.SetLevel(level)
+	if after <= 0 {
+		return
+	}
+
+	r.to = to
+	r.at = time.Now().Add(after)
+	var timer *time.Timer
+	timer = time.AfterFunc(after, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// the timer is replaced if the level is changed again meanwhile
+		if r.timer != timer {
+			return
+		}
+		r.timer = nil
+		from := LogErrorLevel.Level()
+		LogErrorLevel.SetLevel(to)
+		LogError.Info(fmt.Sprintf("reverted log level to %s", to))
+		logAdminAction("loglevel", from.String(), to.String(), zap.String("principal", "revert"))
+	})
+	r.timer = timer
+}
+
+// revertsAt returns the time the level is reverted at, or the zero time if
+// it is not scheduled.
+func (r *logLevelRevert) revertsAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer == nil {
+		return time.Time{}
+	}
+	return r.at
+}
+
+// ConfigLogLevelHandler gets and sets the level of the error log. The level
+// set with the parameter minutes is reverted after the minutes.
+func ConfigLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		sendLogLevelResponse(w)
+		return
+	case "PUT":
+	default:
+		sendResponse(w, "method must be GET or PUT", http.StatusBadRequest)
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		LogError.Error(err.Error())
+		sendResponse(w, "url parameters could not be parsed", http.StatusBadRequest)
+		return
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(values.Get("level"))); err != nil || values.Get("level") == "" {
+		sendResponse(w, "level must be one of debug, info, warn, error, dpanic, panic or fatal", http.StatusBadRequest)
+		return
+	}
+
+	var minutes int64
+	if in := values.Get("minutes"); in != "" {
+		minutes, err = strconv.ParseInt(in, 0, 64)
+		if err != nil || minutes < 0 {
+			sendResponse(w, "minutes must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	before := LogErrorLevel.Level()
+	errorLogLevelRevert.set(level, time.Duration(minutes)*time.Minute)
+	msg := fmt.Sprintf("changed log level from %s to %s", before, level)
+	if minutes > 0 {
+		msg += fmt.Sprintf(" for %d minutes", minutes)
+	}
+	LogError.Info(msg)
+	LogAdminAction(r, "loglevel", before.String(), level.String())
+
+	sendLogLevelResponse(w)
+}
+
+func sendLogLevelResponse(w http.ResponseWriter) {
+	resp := ResponseLogLevel{Level: LogErrorLevel.Level().String()}
+	if at := errorLogLevelRevert.revertsAt(); !at.IsZero() {
+		resp.RevertsAt = at.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,81 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConfigLogLevelHandler(t *testing.T) {
+	errorBefore := LogError
+	levelBefore := LogErrorLevel.Level()
+	defer func() {
+		errorLogLevelRevert.set(levelBefore, 0)
+		LogError = errorBefore
+	}()
+	var err error
+	LogError, _, err = InitLogLevel("discard", LogErrorLevel)
+	require.NoError(t, err)
+	LogErrorLevel.SetLevel(zap.ErrorLevel)
+
+	call := func(method, url string) (int, ResponseLogLevel) {
+		w := httptest.NewRecorder()
+		ConfigLogLevelHandler(w, httptest.NewRequest(method, url, nil))
+		var resp ResponseLogLevel
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, resp
+	}
+
+	code, resp := call("GET", "/config/loglevel")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "error", resp.Level)
+	assert.Empty(t, resp.RevertsAt)
+
+	for _, url := range []string{"/config/loglevel", "/config/loglevel?level=verbose", "/config/loglevel?level=debug&minutes=-1", "/config/loglevel?level=debug&minutes=x"} {
+		code, _ = call("PUT", url)
+		assert.Equal(t, http.StatusBadRequest, code, url)
+	}
+	code, _ = call("POST", "/config/loglevel?level=debug")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.False(t, LogError.Core().Enabled(zap.DebugLevel))
+
+	code, resp = call("PUT", "/config/loglevel?level=debug&minutes=10")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "debug", resp.Level)
+	revertsAt, err := time.Parse(time.RFC3339, resp.RevertsAt)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), revertsAt, 2*time.Second)
+	assert.True(t, LogError.Core().Enabled(zap.DebugLevel))
+
+	// the level is not reverted if changed without minutes
+	code, resp = call("PUT", "/config/loglevel?level=info")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "info", resp.Level)
+	assert.Empty(t, resp.RevertsAt)
+}
+
+func TestLogLevelRevert(t *testing.T) {
+	levelBefore := LogErrorLevel.Level()
+	defer func() {
+		errorLogLevelRevert.set(levelBefore, 0)
+	}()
+	LogErrorLevel.SetLevel(zap.ErrorLevel)
+
+	errorLogLevelRevert.set(zap.DebugLevel, time.Hour)
+	// changed again before reverted. It is reverted to the original level.
+	errorLogLevelRevert.set(zap.InfoLevel, 50*time.Millisecond)
+	assert.Equal(t, zap.InfoLevel, LogErrorLevel.Level())
+
+	assert.Eventually(t, func() bool {
+		return LogErrorLevel.Level() == zap.ErrorLevel
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, errorLogLevelRevert.revertsAt().IsZero())
+}
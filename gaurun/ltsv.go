@@ -0,0 +1,140 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+var ltsvPool = buffer.NewPool()
+
+// ltsvEncoder encodes the logs in LTSV (Labeled Tab-separated Values) for
+// log.format = "ltsv". It converts the output of the JSON encoder, so the
+// labels are the same as the keys of JSON. The strings are escaped with
+// backslashes and the other values are written as JSON.
+type ltsvEncoder struct {
+	zapcore.Encoder
+}
+
+func newLTSVEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
+	return &ltsvEncoder{Encoder: zapcore.NewJSONEncoder(cfg)}
+}
+
+func (enc *ltsvEncoder) Clone() zapcore.Encoder {
+	return &ltsvEncoder{Encoder: enc.Encoder.Clone()}
+}
+
+func (enc *ltsvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	buf, err := enc.Encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Free()
+
+	line := ltsvPool.Get()
+	if err := jsonToLTSV(line, buf.Bytes()); err != nil {
+		line.Free()
+		return nil, err
+	}
+	line.AppendByte('\n')
+	return line, nil
+}
+
+// jsonToLTSV writes the flat JSON object in LTSV keeping the order of keys.
+func jsonToLTSV(buf *buffer.Buffer, b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("log entry is not a JSON object")
+	}
+	for i := 0; dec.More(); i++ {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		if i > 0 {
+			buf.AppendByte('\t')
+		}
+		buf.AppendString(key)
+		buf.AppendByte(':')
+		if len(raw) > 0 && raw[0] == '"' {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return err
+			}
+			buf.AppendString(ltsvEscaper.Replace(s))
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil {
+				return err
+			}
+			buf.Write(compact.Bytes())
+		}
+	}
+	return nil
+}
+
+var (
+	ltsvEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	ltsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+// UnmarshalLTSV parses the line of the log written with log.format = "ltsv"
+// into v, a pointer to the struct with json tags like LogPushEntry.
+func UnmarshalLTSV(line []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("UnmarshalLTSV needs a pointer to struct (got %T)", v)
+	}
+
+	// the labels of the fields mapped to whether the values are strings,
+	// which are not JSON
+	labels := make(map[string]bool)
+	rt := rv.Elem().Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		labels[name] = f.Type.Kind() == reflect.String
+	}
+
+	obj := make(map[string]json.RawMessage)
+	for _, field := range strings.Split(strings.TrimRight(string(line), "\r\n"), "\t") {
+		i := strings.IndexByte(field, ':')
+		if i < 0 {
+			return fmt.Errorf("invalid LTSV field: %q", field)
+		}
+		label, value := field[:i], field[i+1:]
+		isString, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if isString {
+			b, err := json.Marshal(ltsvUnescaper.Replace(value))
+			if err != nil {
+				return err
+			}
+			obj[label] = b
+		} else if value != "" {
+			obj[label] = json.RawMessage(value)
+		}
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,64 @@
+package gaurun
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLTSVLog(t *testing.T) {
+	formatBefore := ConfGaurun.Log.Format
+	accessBefore := LogAccess
+	defer func() {
+		ConfGaurun.Log.Format = formatBefore
+		LogAccess = accessBefore
+	}()
+	ConfGaurun.Log.Format = LogFormatLTSV
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	var err error
+	LogAccess, _, err = InitLog(path, "info")
+	require.NoError(t, err)
+
+	req := RequestGaurunNotification{
+		Platform: PlatFormIos,
+		Message:  "hello\tworld\n\\n",
+		Badge:    1,
+		Extend:   []ExtendJSON{{Key: "url", Value: "https://example.com/"}},
+	}
+	LogPush(1, StatusAcceptedPush, "test token", 0.5, req, nil)
+	require.NoError(t, LogAccess.Sync())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	line := strings.TrimSuffix(string(b), "\n")
+	assert.NotContains(t, line, "\n")
+	assert.True(t, strings.HasPrefix(line, "level:info\ttime:"), line)
+	assert.Contains(t, line, "\ttype:accepted-push\t")
+	assert.Contains(t, line, `	message:hello\tworld\n\\n	`)
+	assert.Contains(t, line, `	extend:[{"key":"url","val":"https://example.com/"}]`)
+
+	var entry LogPushEntry
+	require.NoError(t, UnmarshalLTSV([]byte(line), &entry))
+	assert.Equal(t, StatusAcceptedPush, entry.Type)
+	assert.Equal(t, uint64(1), entry.ID)
+	assert.Equal(t, "test token", entry.Token)
+	assert.Equal(t, req.Message, entry.Message)
+	assert.Equal(t, 1, entry.Badge)
+	assert.Equal(t, 0.5, entry.Ptime)
+	assert.Equal(t, req.Extend, entry.Extend)
+}
+
+func TestUnmarshalLTSV(t *testing.T) {
+	var entry LogPushEntry
+	assert.Error(t, UnmarshalLTSV([]byte("no label"), &entry))
+	assert.Error(t, UnmarshalLTSV([]byte("id:abc"), &entry))
+	assert.Error(t, UnmarshalLTSV([]byte("id:1"), entry))
+
+	require.NoError(t, UnmarshalLTSV([]byte("type:failed-push\tid:2\terror:a:b\tunknown:x\n"), &entry))
+	assert.Equal(t, LogPushEntry{Type: StatusFailedPush, ID: 2, Error: "a:b"}, entry)
+}
@@ -0,0 +1,111 @@
+package gaurun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const (
+	// maskedTokenPrefixLength is the number of characters left by
+	// log.token_mask = "truncate".
+	maskedTokenPrefixLength = 8
+	// redactedContent replaces the content with log.content = "redact".
+	redactedContent = "<redacted>"
+)
+
+// MaskToken masks the device token for logs according to log.token_mask.
+// The hashed and truncated tokens are stable, so the logs of the same
+// token can still be correlated.
+func MaskToken(token string) string {
+	switch ConfGaurun.Log.TokenMask {
+	case LogTokenMaskHash:
+		mac := hmac.New(sha256.New, []byte(ConfGaurun.Log.TokenHashKey))
+		mac.Write([]byte(token))
+		return hex.EncodeToString(mac.Sum(nil))
+	case LogTokenMaskTruncate:
+		if len(token) <= maskedTokenPrefixLength {
+			return token
+		}
+		return token[:maskedTokenPrefixLength] + "..."
+	}
+	return token
+}
+
+// MaskNotification returns the copy of req with the tokens masked and the
+// message, the title, the subtitle and the values of extend redacted or
+// omitted according to log.token_mask and log.content.
+func MaskNotification(req RequestGaurunNotification) RequestGaurunNotification {
+	if logMasksNothing() {
+		return req
+	}
+
+	if len(req.Tokens) > 0 {
+		tokens := make([]string, len(req.Tokens))
+		for i, token := range req.Tokens {
+			tokens[i] = MaskToken(token)
+		}
+		req.Tokens = tokens
+	}
+
+	switch ConfGaurun.Log.Content {
+	case LogContentRedact:
+		redact := func(s string) string {
+			if s == "" {
+				return s
+			}
+			return redactedContent
+		}
+		req.Message = redact(req.Message)
+		req.Title = redact(req.Title)
+		req.Subtitle = redact(req.Subtitle)
+		if len(req.Extend) > 0 {
+			extend := make([]ExtendJSON, len(req.Extend))
+			for i, e := range req.Extend {
+				extend[i] = ExtendJSON{Key: e.Key, Value: redact(e.Value)}
+			}
+			req.Extend = extend
+		}
+	case LogContentOmit:
+		req.Message = ""
+		req.Title = ""
+		req.Subtitle = ""
+		req.Extend = nil
+	}
+	return req
+}
+
+// logMasksNothing reports whether the logs have the tokens and the content
+// as they are.
+func logMasksNothing() bool {
+	switch ConfGaurun.Log.TokenMask {
+	case LogTokenMaskHash, LogTokenMaskTruncate:
+		return false
+	}
+	switch ConfGaurun.Log.Content {
+	case LogContentRedact, LogContentOmit:
+		return false
+	}
+	return true
+}
+
+// maskRequestBody masks the body of POST /push for the debug log.
+// The body is redacted entirely if it can not be parsed.
+func maskRequestBody(body []byte) string {
+	if logMasksNothing() {
+		return string(body)
+	}
+	var req RequestGaurun
+	if err := json.Unmarshal(body, &req); err != nil {
+		return redactedContent
+	}
+	for i := range req.Notifications {
+		req.Notifications[i] = MaskNotification(req.Notifications[i])
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return redactedContent
+	}
+	return string(b)
+}
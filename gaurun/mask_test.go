@@ -0,0 +1,153 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withLogMask(t *testing.T, tokenMask, content string) func() {
+	t.Helper()
+	logBefore := ConfGaurun.Log
+	ConfGaurun.Log.TokenMask = tokenMask
+	ConfGaurun.Log.TokenHashKey = "secret"
+	ConfGaurun.Log.Content = content
+	return func() {
+		ConfGaurun.Log = logBefore
+	}
+}
+
+func TestMaskToken(t *testing.T) {
+	token := strings.Repeat("0123abcd", 8)
+
+	restore := withLogMask(t, LogTokenMaskNone, LogContentFull)
+	assert.Equal(t, token, MaskToken(token))
+	restore()
+
+	restore = withLogMask(t, LogTokenMaskTruncate, LogContentFull)
+	assert.Equal(t, "0123abcd...", MaskToken(token))
+	assert.Equal(t, "short", MaskToken("short"))
+	restore()
+
+	restore = withLogMask(t, LogTokenMaskHash, LogContentFull)
+	hashed := MaskToken(token)
+	assert.Len(t, hashed, 64)
+	assert.NotContains(t, hashed, token)
+	assert.Equal(t, hashed, MaskToken(token))
+	assert.NotEqual(t, hashed, MaskToken(strings.Repeat("0123abce", 8)))
+	ConfGaurun.Log.TokenHashKey = "other secret"
+	assert.NotEqual(t, hashed, MaskToken(token))
+	restore()
+}
+
+func TestMaskNotification(t *testing.T) {
+	req := RequestGaurunNotification{
+		Tokens:     []string{"token1", "token2"},
+		Platform:   PlatFormIos,
+		Message:    "hello",
+		Title:      "title",
+		Identifier: "campaign",
+		Extend:     []ExtendJSON{{Key: "url", Value: "https://example.com"}},
+	}
+
+	restore := withLogMask(t, LogTokenMaskNone, LogContentFull)
+	assert.Equal(t, req, MaskNotification(req))
+	restore()
+
+	restore = withLogMask(t, LogTokenMaskTruncate, LogContentRedact)
+	masked := MaskNotification(req)
+	assert.Equal(t, []string{"token1", "token2"}, masked.Tokens)
+	assert.Equal(t, "<redacted>", masked.Message)
+	assert.Equal(t, "<redacted>", masked.Title)
+	assert.Empty(t, masked.Subtitle)
+	assert.Equal(t, "campaign", masked.Identifier)
+	assert.Equal(t, []ExtendJSON{{Key: "url", Value: "<redacted>"}}, masked.Extend)
+	restore()
+
+	restore = withLogMask(t, LogTokenMaskHash, LogContentOmit)
+	masked = MaskNotification(req)
+	assert.Equal(t, MaskToken("token1"), masked.Tokens[0])
+	assert.Empty(t, masked.Message)
+	assert.Empty(t, masked.Title)
+	assert.Empty(t, masked.Extend)
+	restore()
+
+	// the original is left as it is
+	assert.Equal(t, []string{"token1", "token2"}, req.Tokens)
+	assert.Equal(t, "https://example.com", req.Extend[0].Value)
+}
+
+func TestMaskRequestBody(t *testing.T) {
+	body := []byte(`{"notifications":[{"token":["token1"],"platform":1,"message":"hello"}]}`)
+
+	restore := withLogMask(t, LogTokenMaskNone, LogContentFull)
+	assert.Equal(t, string(body), maskRequestBody(body))
+	restore()
+
+	restore = withLogMask(t, LogTokenMaskHash, LogContentRedact)
+	defer restore()
+	masked := maskRequestBody(body)
+	assert.NotContains(t, masked, "token1")
+	assert.NotContains(t, masked, "hello")
+	assert.Contains(t, masked, MaskToken("token1"))
+	assert.Equal(t, "<redacted>", maskRequestBody([]byte(`{"notifications":"token1"`)))
+}
+
+func TestLogPushMasked(t *testing.T) {
+	restore := withLogMask(t, LogTokenMaskHash, LogContentRedact)
+	accessBefore := LogAccess
+	defer func() {
+		restore()
+		LogAccess = accessBefore
+		LogPayload = nil
+	}()
+
+	dir := t.TempDir()
+	var err error
+	LogAccess, _, err = InitLog(filepath.Join(dir, "access.log"), "info")
+	require.NoError(t, err)
+	LogPayload, _, err = InitLogMode(filepath.Join(dir, "payload.log"), "info", 0600)
+	require.NoError(t, err)
+
+	req := RequestGaurunNotification{Tokens: []string{"token1"}, Platform: PlatFormIos, Message: "hello", ID: 1}
+	LogPush(1, StatusAcceptedPush, "token1", 0, req, nil)
+	LogPush(1, StatusSucceededPush, "token1", 0, req, nil)
+	require.NoError(t, LogAccess.Sync())
+	require.NoError(t, LogPayload.Sync())
+
+	readEntries := func(name string) []LogPushEntry {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		var entries []LogPushEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var entry LogPushEntry
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	access := readEntries("access.log")
+	require.Len(t, access, 2)
+	for _, entry := range access {
+		assert.Equal(t, MaskToken("token1"), entry.Token)
+		assert.Equal(t, "<redacted>", entry.Message)
+	}
+
+	// only the accepted push notification is in the payload log
+	payload := readEntries("payload.log")
+	require.Len(t, payload, 1)
+	assert.Equal(t, StatusAcceptedPush, payload[0].Type)
+	assert.Equal(t, "token1", payload[0].Token)
+	assert.Equal(t, "hello", payload[0].Message)
+
+	info, err := os.Stat(filepath.Join(dir, "payload.log"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
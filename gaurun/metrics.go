@@ -0,0 +1,167 @@
+package gaurun
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "gaurun"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricPushTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_total",
+		Help:      "Number of push notifications by platform, status and provider error reason.",
+	}, []string{"platform", "status", "reason"})
+
+	metricPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_duration_seconds",
+		Help:      "Latency of push notification requests to APNs and FCM.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"platform"})
+
+	metricQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time push notifications waited in the internal queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"platform"})
+
+	metricPushRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_retries_total",
+		Help:      "Number of retried push notifications.",
+	}, []string{"platform"})
+
+	metricInvalidTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invalid_tokens_total",
+		Help:      "Number of device tokens rejected for their format.",
+	}, []string{"platform"})
+
+	metricAPIKeyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_key_requests_total",
+		Help:      "Number of requests authenticated by API key.",
+	}, []string{"key"})
+
+	metricAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of requests failed to authenticate by API key and reason.",
+	}, []string{"key", "reason"})
+
+	metricCertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "apns_certificate_expiry_timestamp_seconds",
+		Help:      "Expiration time of the certificate for APNs in unixtime.",
+	}, []string{"topic"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricPushTotal,
+		metricPushDuration,
+		metricQueueWait,
+		metricPushRetries,
+		metricInvalidTokens,
+		metricAPIKeyRequests,
+		metricAuthFailures,
+		metricCertificateExpiry,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Number of push notifications in the internal queue.",
+		}, func() float64 {
+			usage, _ := queueStat()
+			return float64(usage)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_capacity",
+			Help:      "Size of the internal queue.",
+		}, func() float64 {
+			_, max := queueStat()
+			return float64(max)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pushers_active",
+			Help:      "Current number of goroutines for asynchronous pushing.",
+		}, func() float64 { return float64(atomic.LoadInt64(&PusherCountAll)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pusher_max",
+			Help:      "Maximum number of goroutines for asynchronous pushing.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&ConfGaurun.Core.PusherMax) * atomic.LoadInt64(&ConfGaurun.Core.WorkerNum))
+		}),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observePush records a state change of the push notification.
+// ptime is observed only when the notification was sent to the provider.
+func observePush(platform int, status string, ptime float64, err error) {
+	reason := ""
+	if err != nil {
+		reason = pushErrorReason(err)
+	}
+	observePushReason(platform, status, ptime, reason)
+}
+
+// observePushReason is like observePush but takes the reason as it is,
+// e.g. the error in the result of FCM for the push logged as succeeded.
+func observePushReason(platform int, status string, ptime float64, reason string) {
+	plat := platformName(platform)
+	metricPushTotal.WithLabelValues(plat, status, reason).Inc()
+
+	switch status {
+	case StatusSucceededPush, StatusFailedPush:
+		metricPushDuration.WithLabelValues(plat).Observe(ptime)
+	}
+}
+
+func observeQueueWait(req RequestGaurunNotification) {
+	if req.enqueuedAt.IsZero() {
+		return
+	}
+	metricQueueWait.WithLabelValues(platformName(req.Platform)).Observe(time.Since(req.enqueuedAt).Seconds())
+}
+
+func observeRetry(platform int) {
+	metricPushRetries.WithLabelValues(platformName(platform)).Inc()
+}
+
+func observeInvalidToken(platform int) {
+	metricInvalidTokens.WithLabelValues(platformName(platform)).Inc()
+}
+
+func observeAPIKeyRequest(key string) {
+	metricAPIKeyRequests.WithLabelValues(key).Inc()
+}
+
+func observeAuthFailure(key, reason string) {
+	metricAuthFailures.WithLabelValues(key, reason).Inc()
+}
+
+func observeCertificateExpiry(client APNsClient) {
+	metricCertificateExpiry.Reset()
+	if client.Certificate == nil {
+		return
+	}
+	topic := (&ApnsCredentialInfo{Certificate: client.Certificate}).Topic()
+	metricCertificateExpiry.WithLabelValues(topic).Set(float64(client.Certificate.NotAfter.Unix()))
+}
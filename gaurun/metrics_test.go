@@ -0,0 +1,75 @@
+package gaurun
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestPushErrorReason(t *testing.T) {
+	cases := []struct {
+		Err      error
+		Expected string
+	}{
+		{&push.Error{Reason: push.ErrUnregistered}, "Unregistered"},
+		{&push.Error{Reason: push.ErrBadCertificate}, "BadCertificate"},
+		{&gcm.StatusError{StatusCode: http.StatusServiceUnavailable}, "ServiceUnavailable"},
+		{&url.Error{Op: "Post", Err: timeoutError{}}, "Timeout"},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, "ConnectionRefused"},
+		{&url.Error{Op: "Post", Err: errors.New("remote error: tls: bad certificate")}, "TLSError"},
+		{errors.New("something wrong"), "Other"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.Expected, pushErrorReason(c.Err), fmt.Sprintf("%v", c.Err))
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	QueueNotification = make(chan RequestGaurunNotification, 10)
+	metricPushTotal.Reset()
+	metricPushDuration.Reset()
+	metricPushRetries.Reset()
+	observePush(PlatFormIos, StatusFailedPush, 0.1, &push.Error{Reason: push.ErrUnregistered})
+	observePush(PlatFormAndroid, StatusSucceededPush, 0.1, nil)
+	observePushReason(PlatFormAndroid, StatusSucceededPush, 0.1, "NotRegistered")
+	observeRetry(PlatFormIos)
+
+	s := httptest.NewServer(MetricsHandler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+
+	for _, expected := range []string{
+		`gaurun_push_total{platform="ios",reason="Unregistered",status="failed-push"} 1`,
+		`gaurun_push_total{platform="android",reason="",status="succeeded-push"} 1`,
+		`gaurun_push_total{platform="android",reason="NotRegistered",status="succeeded-push"} 1`,
+		`gaurun_push_duration_seconds_count{platform="ios"} 1`,
+		`gaurun_push_retries_total{platform="ios"} 1`,
+		`gaurun_queue_capacity 10`,
+		`gaurun_queue_depth 0`,
+	} {
+		assert.Contains(t, string(body), expected)
+	}
+}
@@ -2,6 +2,7 @@ package gaurun
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,10 @@ import (
 	"github.com/mercari/gaurun/buford/push"
 	"github.com/mercari/gaurun/gcm"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -26,6 +31,8 @@ type RequestGaurunNotification struct {
 	Platform   int      `json:"platform"`
 	Message    string   `json:"message"`
 	Identifier string   `json:"identifier,omitempty"`
+	DryRun     bool     `json:"dry_run,omitempty"`
+	Truncate   bool     `json:"truncate,omitempty"`
 	// Android
 	CollapseKey    string `json:"collapse_key,omitempty"`
 	DelayWhileIdle bool   `json:"delay_while_idle,omitempty"`
@@ -35,6 +42,7 @@ type RequestGaurunNotification struct {
 	Title            string       `json:"title,omitempty"`
 	Subtitle         string       `json:"subtitle,omitempty"`
 	PushType         string       `json:"push_type,omitempty"`
+	ApnsID           string       `json:"apns_id,omitempty"`
 	Badge            int          `json:"badge,omitempty"`
 	Category         string       `json:"category,omitempty"`
 	Sound            string       `json:"sound,omitempty"`
@@ -44,7 +52,32 @@ type RequestGaurunNotification struct {
 	Retry            int          `json:"retry,omitempty"`
 	Extend           []ExtendJSON `json:"extend,omitempty"`
 	// meta
-	ID uint64 `json:"seq_id,omitempty"`
+	ID         uint64          `json:"seq_id,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"` // the ID of the request to POST /push
+	Truncated  bool            `json:"truncated,omitempty"`  // the message or the title is truncated to fit the payload
+	MessageID  string          `json:"-"`                    // the ID given by the provider on success
+	enqueuedAt time.Time       // for metrics of queue wait time
+	traceCtx   context.Context // holds the span the notification belongs to
+}
+
+// context returns the context holding the span the notification belongs to.
+func (req *RequestGaurunNotification) context() context.Context {
+	if req.traceCtx == nil {
+		return context.Background()
+	}
+	return req.traceCtx
+}
+
+// IsDryRun reports whether the notification is built and logged without
+// being delivered to devices.
+func (req *RequestGaurunNotification) IsDryRun() bool {
+	return ConfGaurun.Core.DryRun || req.DryRun
+}
+
+// TruncatesMessage reports whether the message and the title are
+// truncated when the payload exceeds the limit of the platform.
+func (req *RequestGaurunNotification) TruncatesMessage() bool {
+	return ConfGaurun.Core.Truncate || req.Truncate
 }
 
 type ExtendJSON struct {
@@ -54,6 +87,8 @@ type ExtendJSON struct {
 
 type ResponseGaurun struct {
 	Message string `json:"message"`
+	// InvalidTokens are the device tokens rejected for their format
+	InvalidTokens []string `json:"invalid_tokens,omitempty"`
 }
 
 type CertificatePem struct {
@@ -61,7 +96,11 @@ type CertificatePem struct {
 	Key  []byte
 }
 
-func enqueueNotifications(notifications []RequestGaurunNotification) {
+func enqueueNotifications(ctx context.Context, notifications []RequestGaurunNotification) {
+	ctx, span := tracer().Start(ctx, "gaurun.enqueue")
+	defer span.End()
+	span.SetAttributes(attribute.Int("gaurun.notifications", len(notifications)))
+
 	for _, notification := range notifications {
 		err := validateNotification(&notification)
 		if err != nil {
@@ -80,11 +119,15 @@ func enqueueNotifications(notifications []RequestGaurunNotification) {
 			notification2 := notification
 			notification2.Tokens = []string{token}
 			notification2.ID = numberingPush()
+			notification2.traceCtx = ctx
 			if enabledPush {
 				LogPush(notification2.ID, StatusAcceptedPush, token, 0, notification2, nil)
-				QueueNotification <- notification2
+				observePush(notification2.Platform, StatusAcceptedPush, 0, nil)
+				notification2.enqueuedAt = time.Now()
+				enqueue(notification2)
 			} else {
 				LogPush(notification2.ID, StatusDisabledPush, token, 0, notification2, nil)
+				observePush(notification2.Platform, StatusDisabledPush, 0, nil)
 			}
 		}
 	}
@@ -104,30 +147,44 @@ func pushNotificationIos(req RequestGaurunNotification) error {
 		headers = NewApnsHeadersHttp2(&req)
 	}
 	payload := NewApnsPayloadHttp2(&req)
+	dryRun := req.IsDryRun()
 
 	stime := time.Now()
-	err := ApnsPushHttp2(token, service, headers, payload)
+	var err error
+	if dryRun {
+		err = ValidateApnsPushHttp2(token, headers, payload)
+	} else {
+		req.MessageID, err = ApnsPushHttp2WithIDContext(req.context(), token, service, headers, payload)
+	}
 
 	etime := time.Now()
 	ptime := etime.Sub(stime).Seconds()
 
 	if err != nil {
-		atomic.AddInt64(&StatGaurun.Ios.PushError, 1)
+		countPushError(req.Platform, err)
 		LogPush(req.ID, StatusFailedPush, token, ptime, req, err)
+		observePush(req.Platform, StatusFailedPush, ptime, err)
 		return err
 	}
 
+	if dryRun {
+		LogPush(req.ID, StatusDryRunPush, token, ptime, req, nil)
+		observePush(req.Platform, StatusDryRunPush, ptime, nil)
+		LogError.Debug("END push notification for iOS")
+		return nil
+	}
+
 	atomic.AddInt64(&StatGaurun.Ios.PushSuccess, 1)
 	LogPush(req.ID, StatusSucceededPush, token, ptime, req, nil)
+	observePush(req.Platform, StatusSucceededPush, ptime, nil)
 
 	LogError.Debug("END push notification for iOS")
 
 	return nil
 }
 
-func pushNotificationAndroid(req RequestGaurunNotification) error {
-	LogError.Debug("START push notification for Android")
-
+// NewGcmMessage builds the message for FCM to the tokens of req.
+func NewGcmMessage(req *RequestGaurunNotification) *gcm.Message {
 	data := map[string]interface{}{"message": req.Message}
 	if len(req.Extend) > 0 {
 		for _, extend := range req.Extend {
@@ -135,25 +192,60 @@ func pushNotificationAndroid(req RequestGaurunNotification) error {
 		}
 	}
 
-	token := req.Tokens[0]
-
-	msg := gcm.NewMessage(data, token)
+	msg := gcm.NewMessage(data, req.Tokens...)
 	msg.CollapseKey = req.CollapseKey
 	msg.DelayWhileIdle = req.DelayWhileIdle
 	msg.TimeToLive = req.TimeToLive
 	msg.Priority = req.Priority
+	// FCM validates the message without delivering it
+	msg.DryRun = req.IsDryRun()
+
+	return msg
+}
+
+func pushNotificationAndroid(req RequestGaurunNotification) error {
+	LogError.Debug("START push notification for Android")
+
+	token := req.Tokens[0]
+
+	msg := NewGcmMessage(&req)
 
 	stime := time.Now()
-	_, err := GCMClient.Send(msg)
+	resp, err := GCMClient.SendWithContext(req.context(), msg)
 	etime := time.Now()
 	ptime := etime.Sub(stime).Seconds()
+	if err == nil && len(resp.Results) > 0 {
+		req.MessageID = resp.Results[0].MessageID
+	}
 	if err != nil {
-		atomic.AddInt64(&StatGaurun.Android.PushError, 1)
+		countPushError(req.Platform, err)
 		LogPush(req.ID, StatusFailedPush, token, ptime, req, err)
+		observePush(req.Platform, StatusFailedPush, ptime, err)
 		return err
 	}
 
+	// the errors in the results (e.g. NotRegistered) are counted by reason,
+	// but the push is logged as succeeded.
+	reason := ""
+	for _, result := range resp.Results {
+		if result.Error == "" {
+			continue
+		}
+		statAndroidErrorReasons.add(result.Error)
+		if reason == "" {
+			reason = result.Error
+		}
+	}
+
+	if msg.DryRun {
+		LogPush(req.ID, StatusDryRunPush, token, ptime, req, nil)
+		observePushReason(req.Platform, StatusDryRunPush, ptime, reason)
+		LogError.Debug("END push notification for Android")
+		return nil
+	}
+
 	LogPush(req.ID, StatusSucceededPush, token, ptime, req, nil)
+	observePushReason(req.Platform, StatusSucceededPush, ptime, reason)
 
 	atomic.AddInt64(&StatGaurun.Android.PushSuccess, int64(len(req.Tokens)))
 	LogError.Debug("END push notification for Android")
@@ -178,18 +270,77 @@ func validateNotification(notification *RequestGaurunNotification) error {
 	}
 
 	if notification.PushType != "" {
-		if notification.PushType != ApnsPushTypeAlert && notification.PushType != ApnsPushTypeBackground {
-			return fmt.Errorf("push_type must be %s or %s", ApnsPushTypeAlert, ApnsPushTypeBackground)
+		switch notification.PushType {
+		case ApnsPushTypeAlert, ApnsPushTypeBackground, ApnsPushTypeVoIP:
+		default:
+			return fmt.Errorf("push_type must be %s, %s or %s", ApnsPushTypeAlert, ApnsPushTypeBackground, ApnsPushTypeVoIP)
+		}
+	}
+
+	if notification.ApnsID != "" && !isApnsID(notification.ApnsID) {
+		return errors.New("apns_id must be a UUID (e.g. 123e4567-e89b-12d3-a456-426655440000)")
+	}
+
+	// apns-id identifies a delivery, so it cannot be shared by tokens
+	if notification.ApnsID != "" && len(notification.Tokens) > 1 {
+		return errors.New("apns_id is not allowed with multiple tokens")
+	}
+
+	return nil
+}
+
+// payloadSize builds the payload of the notification as the workers do and
+// returns its size and the limit of the platform in bytes.
+func payloadSize(req *RequestGaurunNotification) (int, int, error) {
+	switch req.Platform {
+	case PlatFormIos:
+		b, err := json.Marshal(NewApnsPayloadHttp2(req))
+		if err != nil {
+			return 0, 0, err
 		}
+		return len(b), push.PayloadLimit(NewApnsHeadersHttp2(req).PushType), nil
+	case PlatFormAndroid:
+		size, err := NewGcmMessage(req).DataSize()
+		if err != nil {
+			return 0, 0, err
+		}
+		return size, gcm.MaxDataPayload, nil
 	}
+	return 0, 0, nil
+}
 
+// validatePayloadSize rejects the notification whose payload exceeds the
+// limit of the platform before it is queued.
+func validatePayloadSize(req *RequestGaurunNotification) error {
+	size, limit, err := payloadSize(req)
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return fmt.Errorf("payload size (%d bytes) exceeds the limit (%d bytes)", size, limit)
+	}
 	return nil
 }
 
-func sendResponse(w http.ResponseWriter, msg string, code int) {
-	respGaurun := ResponseGaurun{
-		Message: msg,
+// fitPayloadSize truncates the notification if it is enabled and then
+// validates the size of its payload.
+func fitPayloadSize(req *RequestGaurunNotification) error {
+	req.Truncated = false
+	if req.TruncatesMessage() {
+		truncated, err := truncateNotification(req)
+		if err != nil {
+			return err
+		}
+		req.Truncated = truncated
 	}
+	return validatePayloadSize(req)
+}
+
+func sendResponse(w http.ResponseWriter, msg string, code int) {
+	sendResponseGaurun(w, ResponseGaurun{Message: msg}, code)
+}
+
+func sendResponseGaurun(w http.ResponseWriter, respGaurun ResponseGaurun, code int) {
 	buf := &bytes.Buffer{}
 
 	if err := json.NewEncoder(buf).Encode(respGaurun); err != nil {
@@ -208,6 +359,11 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 	LogAcceptedRequest(r)
 	LogError.Debug("push-request is Accepted")
 
+	// link to the trace of the caller given by traceparent header.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "POST /push", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	LogError.Debug("method check")
 	if r.Method != "POST" {
 		sendResponse(w, "method must be POST", http.StatusBadRequest)
@@ -225,14 +381,14 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 		err       error
 	)
 
-	if ConfGaurun.Log.Level == "debug" {
+	if LogError.Core().Enabled(zap.DebugLevel) {
 		reqBody, ierr := ioutil.ReadAll(r.Body)
 		if ierr != nil {
 			sendResponse(w, "failed to read request-body", http.StatusInternalServerError)
 			return
 		}
 		if m := LogError.Check(zap.DebugLevel, "parse request body"); m != nil {
-			m.Write(zap.String("body", string(reqBody)))
+			m.Write(zap.String("body", maskRequestBody(reqBody)))
 		}
 		err = json.Unmarshal(reqBody, &reqGaurun)
 	} else {
@@ -257,9 +413,41 @@ func PushNotificationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span.SetAttributes(attribute.Int("gaurun.notifications", len(reqGaurun.Notifications)))
+	requestID := requestIDFrom(r.Context())
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.notifications = len(reqGaurun.Notifications)
+	}
+	for i := range reqGaurun.Notifications {
+		reqGaurun.Notifications[i].RequestID = requestID
+	}
+
+	LogError.Debug("payload size check")
+	for i := range reqGaurun.Notifications {
+		if err := fitPayloadSize(&reqGaurun.Notifications[i]); err != nil {
+			msg := fmt.Sprintf("notifications[%d]: %v", i, err)
+			LogError.Error(msg)
+			sendResponse(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	LogError.Debug("token check")
+	notifications, invalidTokens := rejectInvalidTokens(reqGaurun.Notifications)
+	if len(notifications) == 0 {
+		sendResponseGaurun(w, ResponseGaurun{Message: "no valid token", InvalidTokens: invalidTokens}, http.StatusBadRequest)
+		return
+	}
+
 	LogError.Debug("enqueue notification")
-	go enqueueNotifications(reqGaurun.Notifications)
+	// The notifications are pushed after the response, so the request context
+	// must not cancel them. Only the span is taken over.
+	enqueueWg.Add(1)
+	go func() {
+		defer enqueueWg.Done()
+		enqueueNotifications(trace.ContextWithSpan(context.Background(), span), notifications)
+	}()
 
 	LogError.Debug("response to client")
-	sendResponse(w, "ok", http.StatusOK)
+	sendResponseGaurun(w, ResponseGaurun{Message: "ok", InvalidTokens: invalidTokens}, http.StatusOK)
 }
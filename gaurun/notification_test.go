@@ -5,8 +5,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/gcm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,6 +62,15 @@ func TestValidateNotification(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			RequestGaurunNotification{
+				Tokens:   []string{"test token"},
+				Platform: 1,
+				Message:  "test message with apns_id",
+				ApnsID:   "123e4567-e89b-12d3-a456-426655440000",
+			},
+			nil,
+		},
 
 		// negative cases
 		{
@@ -89,7 +101,25 @@ func TestValidateNotification(t *testing.T) {
 				Message:  "test message with identifier",
 				PushType: "notpushtype",
 			},
-			errors.New("push_type must be alert or background"),
+			errors.New("push_type must be alert, background or voip"),
+		},
+		{
+			RequestGaurunNotification{
+				Tokens:   []string{"test token"},
+				Platform: 1,
+				Message:  "test message with apns_id",
+				ApnsID:   "apns-id",
+			},
+			errors.New("apns_id must be a UUID (e.g. 123e4567-e89b-12d3-a456-426655440000)"),
+		},
+		{
+			RequestGaurunNotification{
+				Tokens:   []string{"test token", "test token 2"},
+				Platform: 1,
+				Message:  "test message with apns_id",
+				ApnsID:   "123e4567-e89b-12d3-a456-426655440000",
+			},
+			errors.New("apns_id is not allowed with multiple tokens"),
 		},
 	}
 
@@ -129,3 +159,51 @@ func TestSendResponse(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, string(body), "{\"message\":\"valid message\"}\n")
 }
+
+func TestValidatePayloadSize(t *testing.T) {
+	cases := []struct {
+		Platform int
+		PushType string
+		Size     int
+		Valid    bool
+	}{
+		{PlatFormIos, "", 1000, true},
+		{PlatFormIos, "", push.MaxPayload, false},
+		{PlatFormIos, ApnsPushTypeVoIP, push.MaxPayload, true},
+		{PlatFormIos, ApnsPushTypeVoIP, push.MaxVoIPPayload, false},
+		{PlatFormAndroid, "", 1000, true},
+		{PlatFormAndroid, "", gcm.MaxDataPayload, false},
+	}
+
+	for _, c := range cases {
+		req := &RequestGaurunNotification{
+			Tokens:   []string{"test token"},
+			Platform: c.Platform,
+			PushType: c.PushType,
+			Message:  strings.Repeat("a", c.Size),
+		}
+		err := validatePayloadSize(req)
+		assert.Equal(t, c.Valid, err == nil, "%d %s %d: %v", c.Platform, c.PushType, c.Size, err)
+	}
+}
+
+func TestPushNotificationHandlerPayloadTooLarge(t *testing.T) {
+	confBefore := ConfGaurun
+	queueBefore := QueueNotification
+	defer func() {
+		ConfGaurun = confBefore
+		QueueNotification = queueBefore
+	}()
+	ConfGaurun = BuildDefaultConf()
+	QueueNotification = make(chan RequestGaurunNotification, 10)
+
+	body := `{"notifications":[
+		{"token":["` + strings.Repeat("0123abcd", 8) + `"],"platform":1,"message":"hello"},
+		{"token":["` + strings.Repeat("x", 152) + `"],"platform":2,"message":"` + strings.Repeat("a", gcm.MaxDataPayload) + `"}
+	]}`
+	w := httptest.NewRecorder()
+	PushNotificationHandler(w, httptest.NewRequest("POST", "/push", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "notifications[1]: payload size")
+	assert.Empty(t, QueueNotification)
+}
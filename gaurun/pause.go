@@ -0,0 +1,172 @@
+package gaurun
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// platformPause holds the notifications for a platform while its delivery is paused.
+// It is safe for concurrent use.
+type platformPause struct {
+	mu     sync.Mutex
+	paused bool
+	held   []RequestGaurunNotification
+}
+
+var (
+	pauseIos     platformPause
+	pauseAndroid platformPause
+)
+
+var errHoldFull = errors.New("held notifications exceed core.pause_hold_max")
+
+func pauseOf(platform int) *platformPause {
+	switch platform {
+	case PlatFormIos:
+		return &pauseIos
+	case PlatFormAndroid:
+		return &pauseAndroid
+	}
+	return nil
+}
+
+func (p *platformPause) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+func (p *platformPause) heldCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.held)
+}
+
+// hold keeps req if the delivery is paused. It returns false if not paused,
+// and errHoldFull without keeping req if max notifications are already held.
+func (p *platformPause) hold(req RequestGaurunNotification, max int64) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false, nil
+	}
+	if int64(len(p.held)) >= max {
+		return true, errHoldFull
+	}
+	p.held = append(p.held, req)
+	return true, nil
+}
+
+// pause pauses the delivery and reports whether it was already paused.
+func (p *platformPause) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paused := p.paused
+	p.paused = true
+	return paused
+}
+
+// resume returns the notifications held while paused.
+func (p *platformPause) resume() []RequestGaurunNotification {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	held := p.held
+	p.paused = false
+	p.held = nil
+	return held
+}
+
+// holdIfPaused keeps the notification instead of pushing it while the
+// delivery for its platform is paused. The notification is logged as failed
+// if core.pause_hold_max notifications are already held.
+func holdIfPaused(req RequestGaurunNotification) bool {
+	p := pauseOf(req.Platform)
+	if p == nil {
+		return false
+	}
+	paused, err := p.hold(req, ConfGaurun.Core.PauseHoldMax)
+	if !paused {
+		return false
+	}
+	if err != nil {
+		countPushError(req.Platform, err)
+		LogPush(req.ID, StatusFailedPush, req.Tokens[0], 0, req, err)
+		observePush(req.Platform, StatusFailedPush, 0, err)
+		return true
+	}
+	LogPush(req.ID, StatusPausedPush, req.Tokens[0], 0, req, nil)
+	observePush(req.Platform, StatusPausedPush, 0, nil)
+	return true
+}
+
+// requeueNotifications puts the notifications held while paused back to the queue.
+func requeueNotifications(held []RequestGaurunNotification) {
+	for _, req := range held {
+		enqueue(req)
+	}
+}
+
+func parsePlatform(r *http.Request) (int, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return 0, err
+	}
+	switch values.Get("platform") {
+	case "ios":
+		return PlatFormIos, nil
+	case "android":
+		return PlatFormAndroid, nil
+	}
+	return 0, fmt.Errorf("platform must be ios or android")
+}
+
+// ConfigPauseHandler pauses the delivery of push notifications for a platform.
+// The notifications dequeued while paused are held until resumed.
+func ConfigPauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		sendResponse(w, "method must be PUT", http.StatusBadRequest)
+		return
+	}
+
+	platform, err := parsePlatform(r)
+	if err != nil {
+		sendResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wasPaused := pauseOf(platform).pause()
+	LogError.Info(fmt.Sprintf("paused push notifications for %s", platformName(platform)))
+	LogAdminAction(r, "pause:"+platformName(platform), wasPaused, true)
+
+	sendResponse(w, "ok", http.StatusOK)
+}
+
+// ConfigResumeHandler resumes the delivery of push notifications for a platform
+// and puts the held notifications back to the queue.
+func ConfigResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		sendResponse(w, "method must be PUT", http.StatusBadRequest)
+		return
+	}
+
+	platform, err := parsePlatform(r)
+	if err != nil {
+		sendResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wasPaused := pauseOf(platform).isPaused()
+	held := pauseOf(platform).resume()
+	LogError.Info(fmt.Sprintf("resumed push notifications for %s (%d held)", platformName(platform), len(held)))
+	LogAdminAction(r, "resume:"+platformName(platform), wasPaused, false)
+	enqueueWg.Add(1)
+	go func() {
+		defer enqueueWg.Done()
+		requeueNotifications(held)
+	}()
+
+	sendResponse(w, "ok", http.StatusOK)
+}
@@ -0,0 +1,75 @@
+package gaurun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigPauseHandler(t *testing.T) {
+	origConf, origQueue := ConfGaurun, QueueNotification
+	defer func() {
+		ConfGaurun, QueueNotification = origConf, origQueue
+		pauseIos.resume()
+		pauseAndroid.resume()
+		InitStat()
+	}()
+	ConfGaurun = BuildDefaultConf()
+	ConfGaurun.Core.PauseHoldMax = 1
+	QueueNotification = make(chan RequestGaurunNotification, 1)
+	InitStat()
+
+	cases := []struct {
+		Handler func(http.ResponseWriter, *http.Request)
+		Method  string
+		URL     string
+		Code    int
+	}{
+		{ConfigPauseHandler, "GET", "/config/pause?platform=ios", http.StatusBadRequest},
+		{ConfigPauseHandler, "PUT", "/config/pause", http.StatusBadRequest},
+		{ConfigPauseHandler, "PUT", "/config/pause?platform=windows", http.StatusBadRequest},
+		{ConfigResumeHandler, "POST", "/config/resume?platform=ios", http.StatusBadRequest},
+		{ConfigPauseHandler, "PUT", "/config/pause?platform=ios", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.Handler(w, httptest.NewRequest(c.Method, c.URL, nil))
+		assert.Equal(t, c.Code, w.Code, c.URL)
+	}
+
+	ios := RequestGaurunNotification{ID: 1, Platform: PlatFormIos, Tokens: []string{"token"}}
+	android := RequestGaurunNotification{ID: 2, Platform: PlatFormAndroid, Tokens: []string{"token"}}
+	assert.True(t, holdIfPaused(ios))
+	assert.False(t, holdIfPaused(android))
+
+	// exceeds core.pause_hold_max
+	overflow := RequestGaurunNotification{ID: 3, Platform: PlatFormIos, Tokens: []string{"token"}}
+	assert.True(t, holdIfPaused(overflow))
+
+	stat := getStatApp(t)
+	assert.True(t, stat.Ios.Paused)
+	assert.Equal(t, 1, stat.Ios.PushHeld)
+	assert.Equal(t, int64(1), stat.Ios.PushError)
+	assert.False(t, stat.Android.Paused)
+	assert.Equal(t, 0, stat.Android.PushHeld)
+
+	w := httptest.NewRecorder()
+	ConfigResumeHandler(w, httptest.NewRequest("PUT", "/config/resume?platform=ios", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	select {
+	case req := <-QueueNotification:
+		assert.Equal(t, uint64(1), req.ID)
+	case <-time.After(time.Second):
+		require.Fail(t, "held notification was not requeued")
+	}
+
+	stat = getStatApp(t)
+	assert.False(t, stat.Ios.Paused)
+	assert.Equal(t, 0, stat.Ios.PushHeld)
+	assert.False(t, holdIfPaused(ios))
+}
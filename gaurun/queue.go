@@ -0,0 +1,224 @@
+package gaurun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// queueMu guards QueueNotification and the values below from being
+	// swapped by ResizeQueue while it is referred.
+	queueMu sync.RWMutex
+	// queueSenders counts the goroutines sending to the current QueueNotification
+	queueSenders = &sync.WaitGroup{}
+	// queueChanged is closed when QueueNotification is swapped
+	queueChanged = make(chan struct{})
+	// enqueueWg counts the goroutines which put notifications into the queue
+	// in background. SaveQueue waits for them.
+	enqueueWg sync.WaitGroup
+)
+
+// currentQueue returns QueueNotification and the channel which is closed
+// when it is swapped.
+func currentQueue() (chan RequestGaurunNotification, <-chan struct{}) {
+	queueMu.RLock()
+	defer queueMu.RUnlock()
+	return QueueNotification, queueChanged
+}
+
+// enqueue puts req into QueueNotification. It blocks while the queue is full.
+func enqueue(req RequestGaurunNotification) {
+	queueMu.RLock()
+	queue, senders := QueueNotification, queueSenders
+	senders.Add(1)
+	queueMu.RUnlock()
+
+	defer senders.Done()
+	queue <- req
+}
+
+// queueStat returns the usage and the size of QueueNotification.
+func queueStat() (int, int) {
+	queue, _ := currentQueue()
+	return len(queue), cap(queue)
+}
+
+// ResizeQueue migrates QueueNotification to a new queue with size queueNum.
+// The notifications in the old queue, including the ones which are being
+// sent to it, are moved to the new queue in background.
+func ResizeQueue(queueNum int64) {
+	queueMu.Lock()
+	oldQueue, oldSenders := QueueNotification, queueSenders
+	newQueue := make(chan RequestGaurunNotification, queueNum)
+	QueueNotification = newQueue
+	queueSenders = &sync.WaitGroup{}
+	// the migration is also a sender to the new queue
+	queueSenders.Add(1)
+	close(queueChanged)
+	queueChanged = make(chan struct{})
+	atomic.StoreInt64(&ConfGaurun.Core.QueueNum, queueNum)
+	newSenders := queueSenders
+	queueMu.Unlock()
+
+	go func() {
+		oldSenders.Wait()
+		close(oldQueue)
+	}()
+
+	enqueueWg.Add(1)
+	go func() {
+		defer enqueueWg.Done()
+		defer newSenders.Done()
+		for req := range oldQueue {
+			newQueue <- req
+		}
+	}()
+}
+
+// WaitQueueEmpty blocks until the workers take every notification in the
+// queue or ctx is done. It returns false if ctx is done first.
+func WaitQueueEmpty(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	lastLogged := time.Time{}
+	for {
+		usage, _ := queueStat()
+		if usage == 0 {
+			return true
+		}
+		if time.Since(lastLogged) >= time.Second {
+			LogError.Info(fmt.Sprintf("wait until queue is empty. Current queue len: %d", usage))
+			lastLogged = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// SaveQueue writes the notifications left in the queue and the ones held
+// by PUT /config/pause to path as JSON lines, and returns the number of them.
+// The workers must be stopped before calling it. It waits for the
+// notifications being put into the queue in background.
+//
+// The saved notifications are logged as saved-push, since they are numbered
+// again and logged as accepted by RestoreQueue.
+func SaveQueue(path string) (int, error) {
+	var notifications []RequestGaurunNotification
+	notifications = append(notifications, pauseIos.resume()...)
+	notifications = append(notifications, pauseAndroid.resume()...)
+
+	done := make(chan struct{})
+	go func() {
+		enqueueWg.Wait()
+		close(done)
+	}()
+
+	queue, _ := currentQueue()
+Drain:
+	for {
+		select {
+		case req := <-queue:
+			notifications = append(notifications, req)
+		case <-done:
+			for {
+				select {
+				case req := <-queue:
+					notifications = append(notifications, req)
+				default:
+					break Drain
+				}
+			}
+		}
+	}
+
+	if len(notifications) == 0 {
+		return 0, nil
+	}
+
+	// write to a temporary file and rename it so that a partial file is never restored.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, req := range notifications {
+		if err := enc.Encode(req); err != nil {
+			f.Close()
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+
+	for _, req := range notifications {
+		LogPush(req.ID, StatusSavedPush, req.Tokens[0], 0, req, nil)
+		observePush(req.Platform, StatusSavedPush, 0, nil)
+	}
+	return len(notifications), nil
+}
+
+// RestoreQueue puts the notifications saved by SaveQueue into the queue and
+// removes path. It returns the number of them. It does nothing if path does not exist.
+//
+// The notifications are numbered again and logged as accepted so that
+// gaurun_recover can correlate them with the results.
+func RestoreQueue(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var notifications []RequestGaurunNotification
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var req RequestGaurunNotification
+		if err := dec.Decode(&req); err != nil {
+			return 0, fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+		if len(req.Tokens) == 0 {
+			return 0, fmt.Errorf("failed to decode %s: notification without token", path)
+		}
+		notifications = append(notifications, req)
+	}
+
+	for _, req := range notifications {
+		req.ID = numberingPush()
+		LogPush(req.ID, StatusAcceptedPush, req.Tokens[0], 0, req, nil)
+		observePush(req.Platform, StatusAcceptedPush, 0, nil)
+		req.enqueuedAt = time.Now()
+		enqueue(req)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return len(notifications), err
+	}
+	return len(notifications), nil
+}
@@ -0,0 +1,172 @@
+package gaurun
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizePushWorkers(t *testing.T) {
+	origQueue, origConf := QueueNotification, ConfGaurun
+	defer func() {
+		StopPushWorkers()
+		QueueNotification, ConfGaurun = origQueue, origConf
+		pauseIos.resume()
+	}()
+	ConfGaurun = BuildDefaultConf()
+
+	// hold notifications in workers to observe them
+	pauseIos.pause()
+	req := RequestGaurunNotification{Platform: PlatFormIos, Tokens: []string{"token"}}
+
+	StartPushWorkers(2, 4)
+	assert.Equal(t, int64(2), ConfGaurun.Core.WorkerNum)
+	for i := 0; i < 3; i++ {
+		enqueue(req)
+	}
+	assert.Eventually(t, func() bool { return pauseIos.heldCount() == 3 }, time.Second, 10*time.Millisecond)
+
+	// no worker takes notifications
+	StopPushWorkers()
+	enqueue(req)
+	enqueue(req)
+	time.Sleep(50 * time.Millisecond)
+	stat := getStatApp(t)
+	assert.Equal(t, 2, stat.QueueUsage)
+	assert.Equal(t, 4, stat.QueueMax)
+
+	// notifications in the old queue are migrated
+	ResizeQueue(8)
+	assert.Eventually(t, func() bool {
+		stat := getStatApp(t)
+		return stat.QueueUsage == 2 && stat.QueueMax == 8
+	}, time.Second, 10*time.Millisecond)
+
+	ResizeWorkers(1)
+	assert.Eventually(t, func() bool { return pauseIos.heldCount() == 5 }, time.Second, 10*time.Millisecond)
+}
+
+func TestConfigWorkersHandler(t *testing.T) {
+	origQueue, origConf := QueueNotification, ConfGaurun
+	defer func() {
+		StopPushWorkers()
+		QueueNotification, ConfGaurun = origQueue, origConf
+	}()
+	ConfGaurun = BuildDefaultConf()
+	StartPushWorkers(1, 1)
+
+	cases := []struct {
+		Handler func(http.ResponseWriter, *http.Request)
+		Method  string
+		URL     string
+		Code    int
+	}{
+		{ConfigWorkersHandler, "GET", "/config/workers?num=2", http.StatusBadRequest},
+		{ConfigWorkersHandler, "PUT", "/config/workers?num=0", http.StatusBadRequest},
+		{ConfigWorkersHandler, "PUT", "/config/workers?num=a", http.StatusBadRequest},
+		{ConfigWorkersHandler, "PUT", "/config/workers?num=4097", http.StatusBadRequest},
+		{ConfigWorkersHandler, "PUT", "/config/workers?num=3", http.StatusOK},
+		{ConfigQueuesHandler, "GET", "/config/queues?num=2", http.StatusBadRequest},
+		{ConfigQueuesHandler, "PUT", "/config/queues", http.StatusBadRequest},
+		{ConfigQueuesHandler, "PUT", "/config/queues?num=1048577", http.StatusBadRequest},
+		{ConfigQueuesHandler, "PUT", "/config/queues?num=16", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.Handler(w, httptest.NewRequest(c.Method, c.URL, nil))
+		assert.Equal(t, c.Code, w.Code, c.Method+" "+c.URL)
+	}
+
+	workersMu.Lock()
+	assert.Len(t, workerStops, 3)
+	workersMu.Unlock()
+	assert.Equal(t, int64(3), ConfGaurun.Core.WorkerNum)
+	assert.Equal(t, 16, getStatApp(t).QueueMax)
+	assert.Equal(t, int64(16), atomic.LoadInt64(&ConfGaurun.Core.QueueNum))
+}
+
+func TestSaveAndRestoreQueue(t *testing.T) {
+	origConf, origQueue := ConfGaurun, QueueNotification
+	defer func() {
+		ConfGaurun, QueueNotification = origConf, origQueue
+		pauseAndroid.resume()
+	}()
+	ConfGaurun = BuildDefaultConf()
+	QueueNotification = make(chan RequestGaurunNotification, 1)
+	accessLog := captureAccessLog(t)
+
+	ios := RequestGaurunNotification{
+		ID:       1,
+		Platform: PlatFormIos,
+		Tokens:   []string{"ios-token"},
+		Message:  "hello",
+		Retry:    1,
+		Extend:   []ExtendJSON{{Key: "url", Value: "https://example.com"}},
+	}
+	android := RequestGaurunNotification{ID: 2, Platform: PlatFormAndroid, Tokens: []string{"android-token"}}
+	blocked := RequestGaurunNotification{ID: 3, Platform: PlatFormIos, Tokens: []string{"blocked-token"}}
+
+	enqueue(ios)
+	pauseAndroid.pause()
+	assert.True(t, holdIfPaused(android))
+	// a sender blocked by the full queue
+	enqueueWg.Add(1)
+	go func() {
+		defer enqueueWg.Done()
+		enqueue(blocked)
+	}()
+
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	n, err := SaveQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 0, pauseAndroid.heldCount())
+
+	// the saved ones are done with the IDs
+	saved := map[uint64]string{}
+	for _, entry := range accessLog() {
+		if entry.Type == StatusSavedPush {
+			saved[entry.ID] = entry.Token
+		}
+	}
+	assert.Equal(t, map[uint64]string{1: "ios-token", 2: "android-token", 3: "blocked-token"}, saved)
+
+	QueueNotification = make(chan RequestGaurunNotification, 3)
+	n, err = RestoreQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	restored := map[string]RequestGaurunNotification{}
+	for i := 0; i < 3; i++ {
+		req := <-QueueNotification
+		restored[req.Tokens[0]] = req
+	}
+	assert.Equal(t, "hello", restored["ios-token"].Message)
+	assert.Equal(t, 1, restored["ios-token"].Retry)
+	assert.Equal(t, ios.Extend, restored["ios-token"].Extend)
+	assert.NotEqual(t, uint64(1), restored["ios-token"].ID)
+	assert.Equal(t, PlatFormAndroid, restored["android-token"].Platform)
+	assert.Contains(t, restored, "blocked-token")
+
+	// nothing to save
+	n, err = SaveQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = RestoreQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"token":[],"platform":1}`), 0600))
+	_, err = RestoreQueue(path)
+	assert.Error(t, err)
+}
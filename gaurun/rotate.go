@@ -0,0 +1,219 @@
+package gaurun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat is the suffix of the rotated files.
+const rotateTimeFormat = "20060102-150405"
+
+// rotateWriter writes the logs to the file and rotates it by itself when it
+// grows over log.rotate_size or crosses the boundary of log.rotate_interval,
+// for the hosts without logrotate. The rotated files are named with the time
+// of the rotation and removed beyond log.rotate_backups and log.rotate_max_age.
+type rotateWriter struct {
+	mu       sync.Mutex
+	path     string
+	perm     os.FileMode
+	maxSize  int64
+	interval string
+	backups  int
+	maxAge   time.Duration
+
+	file     *os.File
+	size     int64
+	rotateAt time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func newRotateWriter(path string, perm os.FileMode, conf SectionLog) (*rotateWriter, error) {
+	w := &rotateWriter{
+		path:     path,
+		perm:     perm,
+		maxSize:  conf.RotateSize * 1024 * 1024,
+		interval: conf.RotateInterval,
+		backups:  conf.RotateBackups,
+		maxAge:   time.Duration(conf.RotateMaxAge) * 24 * time.Hour,
+		now:      time.Now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the file to append. The existing file is rotated at the
+// boundary after its last modification.
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, w.perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.rotateAt = w.nextBoundary(info.ModTime())
+	if w.size == 0 {
+		w.rotateAt = w.nextBoundary(w.now())
+	}
+	return nil
+}
+
+// nextBoundary returns the boundary of log.rotate_interval after t in the
+// local time, or the zero time if the interval is not set.
+func (w *rotateWriter) nextBoundary(t time.Time) time.Time {
+	t = t.Local()
+	switch w.interval {
+	case LogRotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.Local)
+	case LogRotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.Local)
+	}
+	return time.Time{}
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+n > w.maxSize {
+		return true
+	}
+	return !w.rotateAt.IsZero() && !w.now().Before(w.rotateAt)
+}
+
+// Reopen reopens the file for the case it is moved by others.
+func (w *rotateWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.close()
+	return w.open()
+}
+
+func (w *rotateWriter) close() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+func (w *rotateWriter) rotate() error {
+	w.close()
+
+	backup := w.path + "." + w.now().Format(rotateTimeFormat)
+	name := backup
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%d", backup, i)
+	}
+	if err := os.Rename(w.path, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	return w.removeBackups()
+}
+
+// backupFiles returns the rotated files from the newest.
+func (w *rotateWriter) backupFiles() ([]string, error) {
+	paths, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		path  string
+		stamp string
+		n     int
+	}
+	backups := make([]backup, 0, len(paths))
+	for _, path := range paths {
+		suffix := strings.TrimPrefix(path, w.path+".")
+		if len(suffix) < len(rotateTimeFormat) {
+			continue
+		}
+		b := backup{path: path, stamp: suffix[:len(rotateTimeFormat)]}
+		if _, err := time.ParseInLocation(rotateTimeFormat, b.stamp, time.Local); err != nil {
+			continue
+		}
+		if rest := suffix[len(rotateTimeFormat):]; rest != "" {
+			// the number added on collision
+			n, err := strconv.Atoi(strings.TrimPrefix(rest, "."))
+			if err != nil || !strings.HasPrefix(rest, ".") {
+				continue
+			}
+			b.n = n
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].stamp != backups[j].stamp {
+			return backups[i].stamp > backups[j].stamp
+		}
+		return backups[i].n > backups[j].n
+	})
+
+	result := make([]string, len(backups))
+	for i, b := range backups {
+		result[i] = b.path
+	}
+	return result, nil
+}
+
+func (w *rotateWriter) removeBackups() error {
+	if w.backups <= 0 && w.maxAge <= 0 {
+		return nil
+	}
+	backups, err := w.backupFiles()
+	if err != nil {
+		return err
+	}
+	for i, path := range backups {
+		remove := w.backups > 0 && i >= w.backups
+		if !remove && w.maxAge > 0 {
+			info, err := os.Stat(path)
+			remove = err == nil && w.now().Sub(info.ModTime()) > w.maxAge
+		}
+		if remove {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gaurun
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateWriterSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gaurun.log")
+	w, err := newRotateWriter(path, 0644, SectionLog{RotateSize: 1, RotateBackups: 2})
+	require.NoError(t, err)
+	defer w.close()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	w.now = func() time.Time { return now }
+
+	line := make([]byte, 600*1024)
+	for i := 0; i < 5; i++ {
+		_, err := w.Write(line)
+		require.NoError(t, err)
+		now = now.Add(time.Second)
+	}
+
+	backups, err := w.backupFiles()
+	require.NoError(t, err)
+	assert.Equal(t, []string{path + ".20200102-030409", path + ".20200102-030408"}, backups)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(line)), info.Size())
+}
+
+func TestRotateWriterInterval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gaurun.log")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+
+	// the existing file is rotated at the boundary after its last write
+	require.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+	require.NoError(t, os.Chtimes(path, now.Add(-24*time.Hour), now.Add(-24*time.Hour)))
+	w, err := newRotateWriter(path, 0644, SectionLog{RotateInterval: LogRotateDaily})
+	require.NoError(t, err)
+	defer w.close()
+	w.now = func() time.Time { return now }
+
+	write := func(s string) {
+		_, err := w.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	write("a\n")
+	assert.Equal(t, time.Date(2020, 1, 3, 0, 0, 0, 0, time.Local), w.rotateAt)
+	write("b\n")
+
+	now = time.Date(2020, 1, 3, 0, 0, 0, 0, time.Local)
+	write("c\n")
+
+	b, err := ioutil.ReadFile(path + ".20200102-030405")
+	require.NoError(t, err)
+	assert.Equal(t, "old\n", string(b))
+	b, err = ioutil.ReadFile(path + ".20200103-000000")
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(b))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "c\n", string(b))
+}
+
+func TestRotateWriterMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gaurun.log")
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.Local)
+
+	old := path + ".20200101-000000"
+	recent := path + ".20200109-000000"
+	other := path + ".gz"
+	for _, p := range []string{old, recent, other} {
+		require.NoError(t, ioutil.WriteFile(p, nil, 0644))
+	}
+	require.NoError(t, os.Chtimes(old, now.AddDate(0, 0, -9), now.AddDate(0, 0, -9)))
+	require.NoError(t, os.Chtimes(recent, now.AddDate(0, 0, -1), now.AddDate(0, 0, -1)))
+
+	w, err := newRotateWriter(path, 0644, SectionLog{RotateInterval: LogRotateHourly, RotateMaxAge: 7})
+	require.NoError(t, err)
+	defer w.close()
+	w.now = func() time.Time { return now }
+	require.NoError(t, w.rotate())
+
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+	for _, p := range []string{recent, other} {
+		_, err = os.Stat(p)
+		assert.NoError(t, err)
+	}
+}
+
+func TestRotateWriterReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gaurun.log")
+	w, err := newRotateWriter(path, 0644, SectionLog{RotateSize: 1})
+	require.NoError(t, err)
+	defer w.close()
+
+	_, err = w.Write([]byte("a\n"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path, path+".moved"))
+	require.NoError(t, w.Reopen())
+	_, err = w.Write([]byte("b\n"))
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "b\n", string(b))
+}
+
+func TestParseSyslogOutput(t *testing.T) {
+	network, addr, err := parseSyslogOutput("syslog")
+	require.NoError(t, err)
+	assert.Equal(t, "", network)
+	assert.Equal(t, "", addr)
+
+	network, addr, err = parseSyslogOutput("syslog:udp:127.0.0.1:514")
+	require.NoError(t, err)
+	assert.Equal(t, "udp", network)
+	assert.Equal(t, "127.0.0.1:514", addr)
+
+	for _, invalid := range []string{"syslog:", "syslog:udp", "syslog:udp:", "syslog:http:localhost"} {
+		_, _, err = parseSyslogOutput(invalid)
+		assert.Error(t, err, invalid)
+	}
+	assert.False(t, isSyslogOutput("syslog.log"))
+}
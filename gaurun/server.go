@@ -13,12 +13,34 @@ import (
 )
 
 func RegisterHandlers(mux *http.ServeMux) {
-	mux.HandleFunc("/push", PushNotificationHandler)
-	mux.HandleFunc("/stat/app", StatsHandler)
-	mux.HandleFunc("/config/pushers", ConfigPushersHandler)
+	// every request is logged on completion. The requests to the APIs
+	// with scope need the API key of it if the authentication is enabled.
+	handle := func(pattern, scope string, handler http.Handler) {
+		if scope != "" {
+			handler = withAuth(scope, handler)
+		}
+		mux.Handle(pattern, withAccessLog(handler))
+	}
+	handleFunc := func(pattern, scope string, handler func(http.ResponseWriter, *http.Request)) {
+		handle(pattern, scope, http.HandlerFunc(handler))
+	}
+
+	handleFunc("/push", AuthScopePush, PushNotificationHandler)
+	handleFunc("/stat/app", AuthScopeStat, StatsHandler)
+	handleFunc("/stat/app/reset", AuthScopeAdmin, StatsResetHandler)
+	handleFunc("/config/pushers", AuthScopeAdmin, ConfigPushersHandler)
+	handleFunc("/config/workers", AuthScopeAdmin, ConfigWorkersHandler)
+	handleFunc("/config/queues", AuthScopeAdmin, ConfigQueuesHandler)
+	handleFunc("/config/pause", AuthScopeAdmin, ConfigPauseHandler)
+	handleFunc("/config/resume", AuthScopeAdmin, ConfigResumeHandler)
+	handleFunc("/config/loglevel", AuthScopeAdmin, ConfigLogLevelHandler)
+	handle("/metrics", AuthScopeStat, MetricsHandler())
+	// the probes of load balancers and orchestrators have no keys
+	handleFunc("/healthz", "", LivenessHandler)
+	handleFunc("/readyz", "", ReadinessHandler)
 
 	statsGo.PrettyPrintEnabled()
-	mux.HandleFunc("/stat/go", statsGo.Handler)
+	handleFunc("/stat/go", AuthScopeStat, statsGo.Handler)
 }
 
 // getListener returns a listener.
@@ -16,8 +16,17 @@ func TestRegisterHandlers(t *testing.T) {
 	entrypoints := []string{
 		"/push",
 		"/stat/app",
+		"/stat/app/reset",
 		"/config/pushers",
+		"/config/workers",
+		"/config/queues",
+		"/config/pause",
+		"/config/resume",
+		"/config/loglevel",
 		"/stat/go",
+		"/metrics",
+		"/healthz",
+		"/readyz",
 	}
 
 	for _, e := range entrypoints {
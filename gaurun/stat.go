@@ -3,6 +3,7 @@ package gaurun
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 	"sync/atomic"
 )
 
@@ -13,37 +14,213 @@ type StatApp struct {
 	PusherCount int64       `json:"pusher_count"`
 	Ios         StatIos     `json:"ios"`
 	Android     StatAndroid `json:"android"`
+	// APIKeys is keyed by the name of the API key, empty if the
+	// authentication is disabled
+	APIKeys map[string]StatAPIKey `json:"api_keys,omitempty"`
+}
+
+type StatAPIKey struct {
+	Requests     int64 `json:"requests"`
+	AuthFailures int64 `json:"auth_failures"`
 }
 
 type StatAndroid struct {
-	PushSuccess int64 `json:"push_success"`
-	PushError   int64 `json:"push_error"`
+	PushSuccess        int64            `json:"push_success"`
+	PushError          int64            `json:"push_error"`
+	PushErrorReasons   map[string]int64 `json:"push_error_reasons"`
+	PushRetry          int64            `json:"push_retry"`
+	PushRetryExhausted int64            `json:"push_retry_exhausted"`
+	InvalidToken       int64            `json:"invalid_token"`
+	Paused             bool             `json:"paused"`
+	PushHeld           int              `json:"push_held"`
 }
 
 type StatIos struct {
-	PushSuccess int64 `json:"push_success"`
-	PushError   int64 `json:"push_error"`
+	PushSuccess        int64            `json:"push_success"`
+	PushError          int64            `json:"push_error"`
+	PushErrorReasons   map[string]int64 `json:"push_error_reasons"`
+	PushRetry          int64            `json:"push_retry"`
+	PushRetryExhausted int64            `json:"push_retry_exhausted"`
+	InvalidToken       int64            `json:"invalid_token"`
+	Paused             bool             `json:"paused"`
+	PushHeld           int              `json:"push_held"`
+}
+
+// errorReasonCounter counts push errors by reason. It is safe for concurrent use.
+type errorReasonCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *errorReasonCounter) add(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[reason]++
+}
+
+func (c *errorReasonCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for reason, n := range c.counts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+func (c *errorReasonCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = make(map[string]int64)
+}
+
+var (
+	statIosErrorReasons     errorReasonCounter
+	statAndroidErrorReasons errorReasonCounter
+)
+
+// apiKeyCounter counts the requests by API key. It is safe for concurrent use.
+type apiKeyCounter struct {
+	mu     sync.Mutex
+	counts map[string]StatAPIKey
+}
+
+func (c *apiKeyCounter) add(key string, fn func(*StatAPIKey)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]StatAPIKey)
+	}
+	stat := c.counts[key]
+	fn(&stat)
+	c.counts[key] = stat
+}
+
+func (c *apiKeyCounter) snapshot() map[string]StatAPIKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]StatAPIKey, len(c.counts))
+	for key, stat := range c.counts {
+		counts[key] = stat
+	}
+	return counts
+}
+
+func (c *apiKeyCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = nil
+}
+
+var statAPIKeys apiKeyCounter
+
+// countAPIKeyRequest counts the request authenticated with the key.
+func countAPIKeyRequest(key string) {
+	statAPIKeys.add(key, func(s *StatAPIKey) { s.Requests++ })
+	observeAPIKeyRequest(key)
+}
+
+// countAuthFailure counts the request failed to authenticate. The failure
+// is counted for the key only if the request tells it.
+func countAuthFailure(key, reason string) {
+	if key != "" {
+		statAPIKeys.add(key, func(s *StatAPIKey) { s.AuthFailures++ })
+	}
+	observeAuthFailure(key, reason)
 }
 
 func InitStat() {
 	StatGaurun.QueueUsage = 0
 	StatGaurun.PusherCount = 0
-	StatGaurun.Ios.PushSuccess = 0
-	StatGaurun.Ios.PushError = 0
-	StatGaurun.Android.PushSuccess = 0
-	StatGaurun.Android.PushError = 0
+	resetStat()
+}
+
+func resetStat() {
+	atomic.StoreInt64(&StatGaurun.Ios.PushSuccess, 0)
+	atomic.StoreInt64(&StatGaurun.Ios.PushError, 0)
+	atomic.StoreInt64(&StatGaurun.Ios.PushRetry, 0)
+	atomic.StoreInt64(&StatGaurun.Ios.PushRetryExhausted, 0)
+	atomic.StoreInt64(&StatGaurun.Ios.InvalidToken, 0)
+	atomic.StoreInt64(&StatGaurun.Android.PushSuccess, 0)
+	atomic.StoreInt64(&StatGaurun.Android.PushError, 0)
+	atomic.StoreInt64(&StatGaurun.Android.PushRetry, 0)
+	atomic.StoreInt64(&StatGaurun.Android.PushRetryExhausted, 0)
+	atomic.StoreInt64(&StatGaurun.Android.InvalidToken, 0)
+	statIosErrorReasons.reset()
+	statAndroidErrorReasons.reset()
+	statAPIKeys.reset()
+}
+
+// countPushError counts the failed push notification by the reason of err.
+func countPushError(platform int, err error) {
+	reason := pushErrorReason(err)
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushError, 1)
+		statIosErrorReasons.add(reason)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushError, 1)
+		statAndroidErrorReasons.add(reason)
+	}
+}
+
+func countPushRetry(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushRetry, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushRetry, 1)
+	}
+}
+
+func countPushRetryExhausted(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.PushRetryExhausted, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.PushRetryExhausted, 1)
+	}
+}
+
+// countInvalidToken counts the device token rejected for its format.
+func countInvalidToken(platform int) {
+	switch platform {
+	case PlatFormIos:
+		atomic.AddInt64(&StatGaurun.Ios.InvalidToken, 1)
+	case PlatFormAndroid:
+		atomic.AddInt64(&StatGaurun.Android.InvalidToken, 1)
+	}
+	observeInvalidToken(platform)
 }
 
 func StatsHandler(w http.ResponseWriter, r *http.Request) {
 	var result StatApp
-	result.QueueMax = cap(QueueNotification)
-	result.QueueUsage = len(QueueNotification)
-	result.PusherMax = ConfGaurun.Core.PusherMax * ConfGaurun.Core.WorkerNum
+	result.QueueUsage, result.QueueMax = queueStat()
+	result.PusherMax = atomic.LoadInt64(&ConfGaurun.Core.PusherMax) * atomic.LoadInt64(&ConfGaurun.Core.WorkerNum)
 	result.PusherCount = atomic.LoadInt64(&PusherCountAll)
 	result.Ios.PushSuccess = atomic.LoadInt64(&StatGaurun.Ios.PushSuccess)
 	result.Ios.PushError = atomic.LoadInt64(&StatGaurun.Ios.PushError)
+	result.Ios.PushErrorReasons = statIosErrorReasons.snapshot()
+	result.Ios.PushRetry = atomic.LoadInt64(&StatGaurun.Ios.PushRetry)
+	result.Ios.PushRetryExhausted = atomic.LoadInt64(&StatGaurun.Ios.PushRetryExhausted)
+	result.Ios.InvalidToken = atomic.LoadInt64(&StatGaurun.Ios.InvalidToken)
+	result.Ios.Paused = pauseIos.isPaused()
+	result.Ios.PushHeld = pauseIos.heldCount()
 	result.Android.PushSuccess = atomic.LoadInt64(&StatGaurun.Android.PushSuccess)
 	result.Android.PushError = atomic.LoadInt64(&StatGaurun.Android.PushError)
+	result.Android.PushErrorReasons = statAndroidErrorReasons.snapshot()
+	result.Android.PushRetry = atomic.LoadInt64(&StatGaurun.Android.PushRetry)
+	result.Android.PushRetryExhausted = atomic.LoadInt64(&StatGaurun.Android.PushRetryExhausted)
+	result.Android.InvalidToken = atomic.LoadInt64(&StatGaurun.Android.InvalidToken)
+	result.Android.Paused = pauseAndroid.isPaused()
+	result.Android.PushHeld = pauseAndroid.heldCount()
+	result.APIKeys = statAPIKeys.snapshot()
 
 	respBody, err := json.MarshalIndent(result, "", " ")
 	if err != nil {
@@ -57,3 +234,16 @@ func StatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", serverHeader())
 	w.Write(respBody)
 }
+
+// StatsResetHandler zeroes the counters of push notifications in /stat/app.
+func StatsResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendResponse(w, "method must be POST", http.StatusBadRequest)
+		return
+	}
+
+	resetStat()
+	LogAdminAction(r, "stat-reset", nil, nil)
+
+	sendResponse(w, "ok", http.StatusOK)
+}
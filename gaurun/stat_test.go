@@ -0,0 +1,88 @@
+package gaurun
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+)
+
+func getStatApp(t *testing.T) StatApp {
+	w := httptest.NewRecorder()
+	StatsHandler(w, httptest.NewRequest("GET", "/stat/app", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var stat StatApp
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &stat))
+	return stat
+}
+
+func TestStatErrorReasons(t *testing.T) {
+	InitStat()
+	defer InitStat()
+
+	countPushError(PlatFormIos, &push.Error{Reason: push.ErrUnregistered})
+	countPushError(PlatFormIos, &push.Error{Reason: push.ErrUnregistered})
+	countPushError(PlatFormIos, &push.Error{Reason: push.ErrBadCertificate})
+	countPushError(PlatFormAndroid, &gcm.StatusError{StatusCode: http.StatusServiceUnavailable})
+
+	stat := getStatApp(t)
+	assert.Equal(t, int64(3), stat.Ios.PushError)
+	assert.Equal(t, map[string]int64{"Unregistered": 2, "BadCertificate": 1}, stat.Ios.PushErrorReasons)
+	assert.Equal(t, int64(1), stat.Android.PushError)
+	assert.Equal(t, map[string]int64{"ServiceUnavailable": 1}, stat.Android.PushErrorReasons)
+}
+
+func TestStatRetry(t *testing.T) {
+	InitStat()
+	defer InitStat()
+
+	calls := 0
+	pusher := func(req RequestGaurunNotification) error {
+		calls++
+		return push.ErrServiceUnavailable
+	}
+	pushWithRetry(pusher, RequestGaurunNotification{Platform: PlatFormIos}, 2)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	pusher = func(req RequestGaurunNotification) error {
+		calls++
+		return errors.New("NotRegistered")
+	}
+	pushWithRetry(pusher, RequestGaurunNotification{Platform: PlatFormAndroid}, 2)
+	assert.Equal(t, 1, calls)
+
+	stat := getStatApp(t)
+	assert.Equal(t, int64(2), stat.Ios.PushRetry)
+	assert.Equal(t, int64(1), stat.Ios.PushRetryExhausted)
+	assert.Equal(t, int64(0), stat.Android.PushRetry)
+	assert.Equal(t, int64(0), stat.Android.PushRetryExhausted)
+}
+
+func TestStatsResetHandler(t *testing.T) {
+	InitStat()
+	defer InitStat()
+
+	countPushError(PlatFormIos, &push.Error{Reason: push.ErrUnregistered})
+	countPushRetry(PlatFormAndroid)
+
+	w := httptest.NewRecorder()
+	StatsResetHandler(w, httptest.NewRequest("GET", "/stat/app/reset", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, int64(1), getStatApp(t).Ios.PushError)
+
+	w = httptest.NewRecorder()
+	StatsResetHandler(w, httptest.NewRequest("POST", "/stat/app/reset", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stat := getStatApp(t)
+	assert.Equal(t, int64(0), stat.Ios.PushError)
+	assert.Empty(t, stat.Ios.PushErrorReasons)
+	assert.Equal(t, int64(0), stat.Android.PushRetry)
+}
@@ -0,0 +1,88 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gaurun
+
+import (
+	"log/syslog"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter writes the logs to syslog. It reconnects by itself, so
+// Reopen does nothing.
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+func newSyslogWriter(out string) (*syslogWriter, error) {
+	network, addr, err := parseSyslogOutput(out)
+	if err != nil {
+		return nil, err
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_USER, syslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{Writer: w}, nil
+}
+
+func (w *syslogWriter) Reopen() error {
+	return nil
+}
+
+// core returns the core sending the entries encoded by encoder to w.
+func (w *syslogWriter) core(encoder zapcore.Encoder, level zapcore.LevelEnabler) zapcore.Core {
+	return &syslogCore{LevelEnabler: level, encoder: encoder, w: w.Writer}
+}
+
+// checkSyslogSupported returns an error if syslog is not available on the platform.
+func checkSyslogSupported() error {
+	return nil
+}
+
+// syslogCore sends each entry to syslog with the severity for its level.
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	w       *syslog.Writer
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &syslogCore{LevelEnabler: c.LevelEnabler, encoder: c.encoder.Clone(), w: c.w}
+	for i := range fields {
+		fields[i].AddTo(clone.encoder)
+	}
+	return clone
+}
+
+func (c *syslogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	msg := buf.String()
+	buf.Free()
+
+	switch {
+	case ent.Level >= zapcore.ErrorLevel:
+		return c.w.Err(msg)
+	case ent.Level == zapcore.WarnLevel:
+		return c.w.Warning(msg)
+	case ent.Level == zapcore.InfoLevel:
+		return c.w.Info(msg)
+	default:
+		return c.w.Debug(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
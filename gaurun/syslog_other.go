@@ -0,0 +1,30 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package gaurun
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/client9/reopen"
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter is not available since log/syslog is not supported.
+type syslogWriter struct {
+	reopen.Writer
+}
+
+func newSyslogWriter(out string) (*syslogWriter, error) {
+	return nil, checkSyslogSupported()
+}
+
+func (w *syslogWriter) core(encoder zapcore.Encoder, level zapcore.LevelEnabler) zapcore.Core {
+	return zapcore.NewNopCore()
+}
+
+// checkSyslogSupported returns an error if syslog is not available on the platform.
+func checkSyslogSupported() error {
+	return fmt.Errorf("syslog output is not supported on %s", runtime.GOOS)
+}
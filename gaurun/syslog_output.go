@@ -0,0 +1,34 @@
+package gaurun
+
+import (
+	"fmt"
+	"strings"
+)
+
+// syslogTag is the tag of the messages sent to syslog.
+const syslogTag = "gaurun"
+
+// isSyslogOutput reports whether the log output is syslog. It is "syslog"
+// for the local daemon or "syslog:<network>:<address>" for the specific one,
+// e.g. "syslog:unixgram:/dev/log" and "syslog:udp:127.0.0.1:514".
+func isSyslogOutput(out string) bool {
+	return out == "syslog" || strings.HasPrefix(out, "syslog:")
+}
+
+// parseSyslogOutput returns the network and the address of the syslog
+// output. Both are empty for the local daemon.
+func parseSyslogOutput(out string) (string, string, error) {
+	if out == "syslog" {
+		return "", "", nil
+	}
+	parts := strings.SplitN(out, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return "", "", fmt.Errorf("syslog output must be syslog:<network>:<address> (got %q)", out)
+	}
+	switch parts[1] {
+	case "unix", "unixgram", "udp", "tcp":
+	default:
+		return "", "", fmt.Errorf("syslog network must be one of unix, unixgram, udp or tcp (got %q)", parts[1])
+	}
+	return parts[1], parts[2], nil
+}
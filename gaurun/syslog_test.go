@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gaurun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogSeverity(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	defer func(conf ConfToml) {
+		ConfGaurun = conf
+	}(ConfGaurun)
+	ConfGaurun = BuildDefaultConf()
+
+	logger, _, err := InitLog("syslog:udp:"+conn.LocalAddr().String(), "debug")
+	require.NoError(t, err)
+	logger.Error("error")
+	logger.Warn("warn")
+	logger.Info("info")
+	logger.Debug("debug")
+
+	// <facility * 8 + severity> of the user-level messages
+	for _, prefix := range []string{"<11>", "<12>", "<14>", "<15>"} {
+		buf := make([]byte, 1024)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, prefix, string(buf[:n])[:len(prefix)])
+	}
+}
@@ -0,0 +1,112 @@
+package gaurun
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mercari/gaurun/buford/push"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// fcmTokenMinLength and fcmTokenMaxLength are the bounds of the length
+	// of registration tokens for FCM, generous enough for legacy GCM ones.
+	fcmTokenMinLength = 32
+	fcmTokenMaxLength = 4096
+)
+
+// ValidateToken checks the format of the device token for the platform.
+// The token is rejected before it is sent to the provider, which would
+// answer with BadDeviceToken or InvalidRegistration.
+func ValidateToken(platform int, token string) error {
+	switch platform {
+	case PlatFormIos:
+		if !push.IsDeviceTokenValid(token) {
+			return errors.New("invalid device token for iOS")
+		}
+	case PlatFormAndroid:
+		if !isFcmTokenValid(token) {
+			return errors.New("invalid registration token for Android")
+		}
+	}
+	return nil
+}
+
+func isFcmTokenValid(token string) bool {
+	if len(token) < fcmTokenMinLength || len(token) > fcmTokenMaxLength {
+		return false
+	}
+	for _, c := range token {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == ':', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeToken fixes the common mistakes in the device token.
+// For iOS, it strips the spaces and the angle brackets of the description
+// of NSData (e.g. "<0123abcd 4567ef89>") and lowercases the hex digits.
+// For Android, it strips only the surrounding spaces because the tokens
+// are case sensitive.
+func NormalizeToken(platform int, token string) string {
+	switch platform {
+	case PlatFormIos:
+		token = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n', '<', '>':
+				return -1
+			}
+			return r
+		}, token)
+		return strings.ToLower(token)
+	case PlatFormAndroid:
+		return strings.TrimSpace(token)
+	}
+	return token
+}
+
+// rejectInvalidTokens removes the malformed tokens from the notifications
+// and returns them. The notifications left without tokens are removed as
+// well. The tokens are normalized first if core.normalize_token is set.
+func rejectInvalidTokens(notifications []RequestGaurunNotification) ([]RequestGaurunNotification, []string) {
+	var (
+		valid   []RequestGaurunNotification
+		invalid []string
+	)
+	for _, notification := range notifications {
+		if len(notification.Tokens) == 0 {
+			valid = append(valid, notification)
+			continue
+		}
+
+		tokens := make([]string, 0, len(notification.Tokens))
+		for _, token := range notification.Tokens {
+			if ConfGaurun.Core.NormalizeToken {
+				token = NormalizeToken(notification.Platform, token)
+			}
+			if token == "" {
+				// leaves it to validateNotification
+				tokens = append(tokens, token)
+				continue
+			}
+			if err := ValidateToken(notification.Platform, token); err != nil {
+				LogError.Error(err.Error(), zap.String("token", MaskToken(token)))
+				countInvalidToken(notification.Platform)
+				invalid = append(invalid, token)
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		notification.Tokens = tokens
+		valid = append(valid, notification)
+	}
+	return valid, invalid
+}
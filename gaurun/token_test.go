@@ -0,0 +1,96 @@
+package gaurun
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateToken(t *testing.T) {
+	cases := []struct {
+		Platform int
+		Token    string
+		Valid    bool
+	}{
+		{PlatFormIos, strings.Repeat("0123abcd", 8), true},
+		{PlatFormIos, strings.Repeat("0123ABCD", 8), true},
+		{PlatFormIos, strings.Repeat("0123abcd", 25), true},
+		{PlatFormIos, strings.Repeat("0123abcd", 7), false},
+		{PlatFormIos, strings.Repeat("0123abcd", 26), false},
+		{PlatFormIos, strings.Repeat("0123abcx", 8), false},
+		{PlatFormIos, "<" + strings.Repeat("0123abcd", 8) + ">", false},
+		{PlatFormAndroid, "dGVzdA:APA91b" + strings.Repeat("Ab0-_", 28), true},
+		{PlatFormAndroid, "short", false},
+		{PlatFormAndroid, strings.Repeat("a", 40) + " " + strings.Repeat("a", 40), false},
+		{PlatFormAndroid, strings.Repeat("a", 40) + "/" + strings.Repeat("a", 40), false},
+		{PlatFormAndroid, strings.Repeat("a", fcmTokenMaxLength+1), false},
+	}
+
+	for _, c := range cases {
+		err := ValidateToken(c.Platform, c.Token)
+		assert.Equal(t, c.Valid, err == nil, "%d %s", c.Platform, c.Token)
+	}
+}
+
+func TestNormalizeToken(t *testing.T) {
+	hex := strings.Repeat("0123abcd", 8)
+	assert.Equal(t, hex, NormalizeToken(PlatFormIos, "<"+strings.ToUpper(hex[:32])+" "+hex[32:]+">"))
+	assert.Equal(t, hex, NormalizeToken(PlatFormIos, " "+hex+"\n"))
+	assert.Equal(t, "AbC:d", NormalizeToken(PlatFormAndroid, " AbC:d\n"))
+}
+
+func TestPushNotificationHandlerInvalidTokens(t *testing.T) {
+	confBefore := ConfGaurun
+	queueBefore := QueueNotification
+	defer func() {
+		ConfGaurun = confBefore
+		QueueNotification = queueBefore
+	}()
+	ConfGaurun = BuildDefaultConf()
+	QueueNotification = make(chan RequestGaurunNotification, 10)
+	resetStat()
+
+	iosToken := strings.Repeat("0123abcd", 8)
+	androidToken := strings.Repeat("x", 152)
+	post := func(body string) (int, ResponseGaurun) {
+		w := httptest.NewRecorder()
+		PushNotificationHandler(w, httptest.NewRequest("POST", "/push", bytes.NewBufferString(body)))
+		var resp ResponseGaurun
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, resp := post(`{"notifications":[
+		{"token":["` + iosToken + `","<` + iosToken + `>"],"platform":1,"message":"hello"},
+		{"token":["xxx"],"platform":2,"message":"hello"},
+		{"token":["` + androidToken + `"],"platform":2,"message":"hello"}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp.Message)
+	assert.Equal(t, []string{"<" + iosToken + ">", "xxx"}, resp.InvalidTokens)
+
+	code, resp = post(`{"notifications":[{"token":["xxx"],"platform":2,"message":"hello"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, []string{"xxx"}, resp.InvalidTokens)
+
+	assert.Equal(t, int64(1), StatGaurun.Ios.InvalidToken)
+	assert.Equal(t, int64(2), StatGaurun.Android.InvalidToken)
+
+	ConfGaurun.Core.NormalizeToken = true
+	code, resp = post(`{"notifications":[{"token":["<` + strings.ToUpper(iosToken) + `>"],"platform":1,"message":"hello"}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.InvalidTokens)
+
+	var tokens []string
+	for len(tokens) < 3 {
+		req := <-QueueNotification
+		tokens = append(tokens, req.Tokens[0])
+	}
+	assert.ElementsMatch(t, []string{iosToken, androidToken, iosToken}, tokens)
+}
@@ -0,0 +1,76 @@
+package gaurun
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInitTracer(t *testing.T) {
+	shutdown, err := InitTracer(SectionTrace{Exporter: TraceExporterNone})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = InitTracer(SectionTrace{Exporter: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestPushNotificationTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	confBefore := ConfGaurun
+	ConfGaurun = BuildDefaultConf()
+	QueueNotification = make(chan RequestGaurunNotification, 1)
+	defer func() {
+		ConfGaurun = confBefore
+	}()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body := `{"notifications":[{"token":["` + strings.Repeat("x", 152) + `"],"platform":2,"message":"hello"}]}`
+	req := httptest.NewRequest("POST", "/push", bytes.NewBufferString(body))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	PushNotificationHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var notification RequestGaurunNotification
+	select {
+	case notification = <-QueueNotification:
+	case <-time.After(time.Second):
+		t.Fatal("notification was not enqueued")
+	}
+
+	pushWithRetry(func(req RequestGaurunNotification) error {
+		return nil
+	}, notification, 0)
+
+	// gaurun.enqueue ends asynchronously after the notification is enqueued.
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for i := 0; i < 100 && len(spans) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+	}
+	require.Contains(t, spans, "POST /push")
+	require.Contains(t, spans, "gaurun.enqueue")
+	require.Contains(t, spans, "gaurun.push")
+	for _, span := range spans {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String(), span.Name())
+	}
+	assert.Equal(t, spans["POST /push"].SpanContext().SpanID(), spans["gaurun.enqueue"].Parent().SpanID())
+	assert.Equal(t, spans["gaurun.enqueue"].SpanContext().SpanID(), spans["gaurun.push"].Parent().SpanID())
+}
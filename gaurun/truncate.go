@@ -0,0 +1,97 @@
+package gaurun
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// ellipsis is appended to the truncated text.
+const ellipsis = "…"
+
+// truncateNotification shortens the message (the alert body), then the
+// title of the notification with an ellipsis until its payload fits the
+// limit of the platform. It reports whether the notification is truncated.
+// The payload may still exceed the limit if the other fields are too large.
+func truncateNotification(req *RequestGaurunNotification) (bool, error) {
+	fits := func() (bool, error) {
+		size, limit, err := payloadSize(req)
+		if err != nil {
+			return false, err
+		}
+		return size <= limit, nil
+	}
+
+	ok, err := fits()
+	if err != nil || ok {
+		return false, err
+	}
+
+	fields := []*string{&req.Message}
+	if req.Platform == PlatFormIos {
+		// the title is not a part of the payload for Android
+		fields = append(fields, &req.Title)
+	}
+
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+		s := *field
+		bounds := graphemeBoundaries(s)
+		// finds the longest prefix which fits by binary search.
+		// bounds[0] is 0, so only the ellipsis is left if nothing fits.
+		lo, hi := 0, len(bounds)-1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			*field = s[:bounds[mid]] + ellipsis
+			ok, err := fits()
+			if err != nil {
+				*field = s
+				return false, err
+			}
+			if ok {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		*field = s[:bounds[lo]] + ellipsis
+
+		ok, err := fits()
+		if err != nil || ok {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// graphemeBoundaries returns the byte offsets in s where it can be cut
+// without breaking a character, excluding len(s). It does not cut before
+// combining marks, variation selectors and emoji modifiers, or around
+// zero width joiners, so that the user-perceived characters are kept.
+func graphemeBoundaries(s string) []int {
+	bounds := []int{0}
+	prev := utf8.RuneError
+	for i, r := range s {
+		if i > 0 && !isGraphemeExtend(r) && prev != zeroWidthJoiner {
+			bounds = append(bounds, i)
+		}
+		prev = r
+	}
+	return bounds
+}
+
+const zeroWidthJoiner = '\u200d'
+
+func isGraphemeExtend(r rune) bool {
+	switch {
+	case r == zeroWidthJoiner:
+		return true
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Variation_Selector):
+		return true
+	case 0x1f3fb <= r && r <= 0x1f3ff:
+		// emoji modifiers (skin tones)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package gaurun
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/gcm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphemeBoundaries(t *testing.T) {
+	assert.Equal(t, []int{0, 1, 2}, graphemeBoundaries("abc"))
+	assert.Equal(t, []int{0, 3, 6}, graphemeBoundaries("あいう"))
+	// e + combining acute accent
+	assert.Equal(t, []int{0, 3}, graphemeBoundaries("e\u0301a"))
+	// man + ZWJ + woman + ZWJ + girl
+	assert.Equal(t, []int{0, 18}, graphemeBoundaries("\U0001f468\u200d\U0001f469\u200d\U0001f467a"))
+	// thumbs up + skin tone, heart + variation selector
+	assert.Equal(t, []int{0, 8}, graphemeBoundaries("\U0001f44d\U0001f3fd\u2764\ufe0f"))
+}
+
+func TestTruncateNotification(t *testing.T) {
+	family := "\U0001f468\u200d\U0001f469\u200d\U0001f467"
+	cases := []struct {
+		Name     string
+		Platform int
+		PushType string
+		Unit     string
+	}{
+		{"ascii", PlatFormIos, "", "a"},
+		{"multibyte", PlatFormIos, "", "あ"},
+		{"emoji sequence", PlatFormIos, "", family},
+		{"voip", PlatFormIos, ApnsPushTypeVoIP, "a"},
+		{"android", PlatFormAndroid, "", "あ"},
+	}
+
+	for _, c := range cases {
+		req := &RequestGaurunNotification{
+			Tokens:   []string{"test token"},
+			Platform: c.Platform,
+			PushType: c.PushType,
+			Message:  strings.Repeat(c.Unit, 6000/len(c.Unit)),
+		}
+		truncated, err := truncateNotification(req)
+		require.NoError(t, err, c.Name)
+		assert.True(t, truncated, c.Name)
+		assert.NoError(t, validatePayloadSize(req), c.Name)
+		assert.True(t, utf8.ValidString(req.Message), c.Name)
+
+		require.True(t, strings.HasSuffix(req.Message, ellipsis), c.Name)
+		kept := strings.TrimSuffix(req.Message, ellipsis)
+		assert.Equal(t, strings.Repeat(c.Unit, len(kept)/len(c.Unit)), kept, c.Name)
+
+		// the longest prefix which fits is kept
+		req.Message = kept + c.Unit + ellipsis
+		assert.Error(t, validatePayloadSize(req), c.Name)
+	}
+}
+
+func TestTruncateNotificationTitle(t *testing.T) {
+	req := &RequestGaurunNotification{
+		Tokens:   []string{"test token"},
+		Platform: PlatFormIos,
+		Message:  strings.Repeat("a", 100),
+		Title:    strings.Repeat("b", push.MaxPayload),
+	}
+	truncated, err := truncateNotification(req)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, ellipsis, req.Message)
+	assert.True(t, strings.HasPrefix(req.Title, "bbb"))
+	assert.True(t, strings.HasSuffix(req.Title, ellipsis))
+	assert.NoError(t, validatePayloadSize(req))
+
+	// the title is not sent to FCM
+	req = &RequestGaurunNotification{
+		Tokens:   []string{"test token"},
+		Platform: PlatFormAndroid,
+		Message:  "hello",
+		Extend:   []ExtendJSON{{Key: "data", Value: strings.Repeat("a", gcm.MaxDataPayload)}},
+	}
+	truncated, err = truncateNotification(req)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Error(t, validatePayloadSize(req))
+
+	req = &RequestGaurunNotification{
+		Tokens:   []string{"test token"},
+		Platform: PlatFormIos,
+		Message:  "hello",
+	}
+	truncated, err = truncateNotification(req)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, "hello", req.Message)
+}
+
+func TestFitPayloadSize(t *testing.T) {
+	truncateBefore := ConfGaurun.Core.Truncate
+	defer func() {
+		ConfGaurun.Core.Truncate = truncateBefore
+	}()
+
+	message := strings.Repeat("a", push.MaxPayload)
+	req := &RequestGaurunNotification{Tokens: []string{"test token"}, Platform: PlatFormIos, Message: message}
+	assert.Error(t, fitPayloadSize(req))
+	assert.False(t, req.Truncated)
+
+	req.Truncate = true
+	assert.NoError(t, fitPayloadSize(req))
+	assert.True(t, req.Truncated)
+
+	ConfGaurun.Core.Truncate = true
+	req = &RequestGaurunNotification{Tokens: []string{"test token"}, Platform: PlatFormIos, Message: message}
+	assert.NoError(t, fitPayloadSize(req))
+	assert.True(t, req.Truncated)
+	assert.NotEqual(t, message, req.Message)
+}
@@ -1,12 +1,24 @@
 package gaurun
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mercari/gaurun/buford/push"
+	"github.com/mercari/gaurun/gcm"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -18,6 +30,13 @@ var (
 	//
 	// This is used to block main process to shutdown while pusher is still working.
 	PusherWg sync.WaitGroup
+
+	// workersMu guards workerStops
+	workersMu sync.Mutex
+	// workerStops has the channels to stop each running worker
+	workerStops []chan struct{}
+	// workersWg waits for the stopped workers to exit
+	workersWg sync.WaitGroup
 )
 
 func init() {
@@ -25,10 +44,34 @@ func init() {
 }
 
 func StartPushWorkers(workerNum, queueNum int64) {
+	queueMu.Lock()
 	QueueNotification = make(chan RequestGaurunNotification, queueNum)
-	for i := int64(0); i < workerNum; i++ {
-		go pushNotificationWorker()
+	queueMu.Unlock()
+	ResizeWorkers(workerNum)
+}
+
+// ResizeWorkers starts or stops workers so that workerNum workers run.
+// A stopped worker finishes the notification it is handling before it exits.
+func ResizeWorkers(workerNum int64) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+
+	for int64(len(workerStops)) < workerNum {
+		stop := make(chan struct{})
+		workerStops = append(workerStops, stop)
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			pushNotificationWorker(stop)
+		}()
+	}
+	for int64(len(workerStops)) > workerNum {
+		last := len(workerStops) - 1
+		close(workerStops[last])
+		workerStops = workerStops[:last]
 	}
+
+	atomic.StoreInt64(&ConfGaurun.Core.WorkerNum, workerNum)
 }
 
 func isExternalServerError(err error, platform int) bool {
@@ -47,31 +90,113 @@ func isExternalServerError(err error, platform int) bool {
 	return false
 }
 
-func pushSync(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) {
-	PusherWg.Add(1)
-	defer PusherWg.Done()
+// pushErrorReason classifies the error returned by pushers into the reason
+// reported by APNs or FCM, or the kind of the transport error.
+func pushErrorReason(err error) string {
+	switch e := err.(type) {
+	case *push.Error:
+		return e.Reason.Error()
+	case *gcm.StatusError:
+		if text := http.StatusText(e.StatusCode); text != "" {
+			return strings.Replace(text, " ", "", -1)
+		}
+		return fmt.Sprintf("Status%d", e.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "Timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "ConnectionRefused"
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return "ConnectionReset"
+	}
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certificateErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+		recordHeaderErr     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &recordHeaderErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return "TLSError"
+	}
+	return "Other"
+}
+
+// pushWithRetry calls pusher and retries it up to retryMax times while
+// the error is caused by the provider.
+func pushWithRetry(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) {
+	ctx, span := tracer().Start(req.context(), "gaurun.push")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("gaurun.platform", platformName(req.Platform)),
+		attribute.Int64("gaurun.seq_id", int64(req.ID)),
+	)
+	if !req.enqueuedAt.IsZero() {
+		span.SetAttributes(attribute.Float64("gaurun.queue_wait", time.Since(req.enqueuedAt).Seconds()))
+	}
+	req.traceCtx = ctx
+
 Retry:
 	err := pusher(req)
-	if err != nil && req.Retry < retryMax && isExternalServerError(err, req.Platform) {
-		req.Retry++
-		goto Retry
+	if err != nil && isExternalServerError(err, req.Platform) {
+		if req.Retry < retryMax {
+			req.Retry++
+			span.AddEvent("retry", trace.WithAttributes(attribute.Int("gaurun.retry", req.Retry)))
+			observeRetry(req.Platform)
+			countPushRetry(req.Platform)
+			goto Retry
+		}
+		countPushRetryExhausted(req.Platform)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, pushErrorReason(err))
 	}
 }
 
+func pushSync(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int) {
+	PusherWg.Add(1)
+	defer PusherWg.Done()
+	pushWithRetry(pusher, req, retryMax)
+}
+
 func pushAsync(pusher func(req RequestGaurunNotification) error, req RequestGaurunNotification, retryMax int, pusherCount *int64) {
 	defer PusherWg.Done()
-Retry:
-	err := pusher(req)
-	if err != nil && req.Retry < retryMax && isExternalServerError(err, req.Platform) {
-		req.Retry++
-		goto Retry
-	}
+	pushWithRetry(pusher, req, retryMax)
 
 	atomic.AddInt64(pusherCount, -1)
 	atomic.AddInt64(&PusherCountAll, -1)
 }
 
-func pushNotificationWorker() {
+// StopPushWorkers stops all workers and waits until they finish the
+// notifications they are handling.
+func StopPushWorkers() {
+	ResizeWorkers(0)
+	workersWg.Wait()
+}
+
+// ResizePushWorkers resizes the workers and the queue if workerNum or
+// queueNum differs from the current one. It returns the ones before.
+func ResizePushWorkers(workerNum, queueNum int64) (int64, int64) {
+	oldWorkerNum := atomic.LoadInt64(&ConfGaurun.Core.WorkerNum)
+	if workerNum != oldWorkerNum {
+		ResizeWorkers(workerNum)
+		LogError.Info(fmt.Sprintf("resized workers to %d", workerNum))
+	}
+	_, oldQueueNum := queueStat()
+	if int64(oldQueueNum) != queueNum {
+		ResizeQueue(queueNum)
+		LogError.Info(fmt.Sprintf("resized queue to %d", queueNum))
+	}
+	return oldWorkerNum, int64(oldQueueNum)
+}
+
+func pushNotificationWorker(stop <-chan struct{}) {
 	var (
 		retryMax    int
 		pusher      func(req RequestGaurunNotification) error
@@ -82,7 +207,22 @@ func pushNotificationWorker() {
 	pusherCount = 0
 
 	for {
-		notification := <-QueueNotification
+		queue, queueChanged := currentQueue()
+
+		var notification RequestGaurunNotification
+		select {
+		case <-stop:
+			return
+		case <-queueChanged:
+			continue
+		case n, ok := <-queue:
+			if !ok {
+				// the queue was migrated by ResizeQueue
+				continue
+			}
+			notification = n
+		}
+		observeQueueWait(notification)
 
 		switch notification.Platform {
 		case PlatFormIos:
@@ -96,6 +236,10 @@ func pushNotificationWorker() {
 			continue
 		}
 
+		if holdIfPaused(notification) {
+			continue
+		}
+
 		if atomic.LoadInt64(&ConfGaurun.Core.PusherMax) <= 0 {
 			pushSync(pusher, notification, retryMax)
 			continue
@@ -2,10 +2,16 @@ package gcm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -14,6 +20,8 @@ const (
 	FCMSendEndpoint = "https://fcm.googleapis.com/fcm/send"
 )
 
+const tracerName = "github.com/mercari/gaurun/gcm"
+
 const (
 	// fcmPushPriorityHigh and fcmPushPriorityNormal is priority of a delivery message options
 	// See more on https://firebase.google.com/docs/cloud-messaging/concept-options?hl=en#setting-the-priority-of-a-message
@@ -27,8 +35,22 @@ const (
 
 	// maxTimeToLive is max time FCM storage can store messages when the device is offline
 	maxTimeToLive = 2419200 // 4 weeks
+
+	// MaxDataPayload is max size of the data payload in bytes.
+	MaxDataPayload = 4096 // 4KB
 )
 
+// StatusError is returned when the FCM server responds with a status other
+// than "200 OK".
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid status code %d: %s", e.StatusCode, e.Status)
+}
+
 // Client abstracts the interaction between the application server and the
 // FCM server. The developer must obtain an API key from the Google APIs
 // Console page and pass it to the Client so that it can perform authorized
@@ -68,21 +90,36 @@ func NewClient(urlString, apiKey string) (*Client, error) {
 // service unavailability. A non-nil error is returned if a non-recoverable
 // error occurs (i.e. if the response status is not "200 OK").
 func (c *Client) Send(msg *Message) (*Response, error) {
+	return c.SendWithContext(context.Background(), msg)
+}
+
+// SendWithContext is like Send but sends the message with the context.
+// The request is traced as a child span of the span in ctx.
+func (c *Client) SendWithContext(ctx context.Context, msg *Message) (resp *Response, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "fcm.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	if err := msg.validate(); err != nil {
 		return nil, err
 	}
 
-	return c.send(msg)
+	return c.send(ctx, msg)
 }
 
-func (c *Client) send(msg *Message) (*Response, error) {
+func (c *Client) send(ctx context.Context, msg *Message) (*Response, error) {
 	var buf bytes.Buffer
 	encoder := json.NewEncoder(&buf)
 	if err := encoder.Encode(msg); err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", c.URL, &buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL, &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -95,8 +132,10 @@ func (c *Client) send(msg *Message) (*Response, error) {
 	}
 	defer resp.Body.Close()
 
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid status code %d: %s", resp.StatusCode, resp.Status)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	var response Response
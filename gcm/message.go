@@ -1,6 +1,7 @@
 package gcm
 
 import (
+	"encoding/json"
 	"fmt"
 )
 
@@ -25,6 +26,18 @@ func NewMessage(data map[string]interface{}, regIDs ...string) *Message {
 	return &Message{RegistrationIDs: regIDs, Data: data}
 }
 
+// DataSize returns the size of the data payload in bytes.
+func (m *Message) DataSize() (int, error) {
+	if len(m.Data) == 0 {
+		return 0, nil
+	}
+	b, err := json.Marshal(m.Data)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
 // validate validates message format. If not well-formated returns error.
 func (m *Message) validate() error {
 	if m == nil {
@@ -55,5 +68,13 @@ func (m *Message) validate() error {
 		return fmt.Errorf("priority must be %s or %s", fcmPushPriorityHigh, fcmPushPriorityNormal)
 	}
 
+	size, err := m.DataSize()
+	if err != nil {
+		return err
+	}
+	if size > MaxDataPayload {
+		return fmt.Errorf("the message's Data field must be at most %d bytes (got %d bytes)", MaxDataPayload, size)
+	}
+
 	return nil
 }
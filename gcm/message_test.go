@@ -1,6 +1,9 @@
 package gcm
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestValidateMessage(t *testing.T) {
 	cases := []struct {
@@ -93,6 +96,15 @@ func TestValidateMessage(t *testing.T) {
 			},
 			false,
 		},
+
+		// test should fail when message Data is larger than MaxDataPayload
+		{
+			&Message{
+				RegistrationIDs: []string{"1"},
+				Data:            map[string]interface{}{"message": strings.Repeat("a", MaxDataPayload)},
+			},
+			false,
+		},
 	}
 
 	for i, tc := range cases {